@@ -0,0 +1,56 @@
+// Command scamp-cache-writer listens for discovery announcements and keeps the
+// discovery cache file (discovery.cache_path) up to date for services that read it.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gudtech/scamp-go/scamp"
+)
+
+func main() {
+	configPath := flag.String("config", scamp.DefaultConfigPath, "path to the soa.conf")
+	cachePath := flag.String("cache", "", "cache file to write (defaults to discovery.cache_path)")
+	flag.Parse()
+
+	config := scamp.NewConfig()
+	err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("could not load config: %s", err)
+	}
+	scamp.SetDefaultConfig(config)
+
+	if *cachePath == "" {
+		path, found := config.Get("discovery.cache_path")
+		if !found {
+			log.Fatalf("no such config param `discovery.cache_path` and no -cache given")
+		}
+		*cachePath = path
+	}
+
+	cache := scamp.NewMemoryServiceCache()
+	listener, err := scamp.NewDiscoveryListener(cache)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	writer := scamp.NewCacheWriter(cache, *cachePath)
+
+	go listener.Listen()
+	go writer.Run()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	listener.Stop()
+	writer.Stop()
+	// leave a final snapshot behind for readers that start before we are restarted
+	err = writer.Write()
+	if err != nil {
+		log.Fatalf("write cache: %s", err)
+	}
+}
@@ -2,6 +2,7 @@ module github.com/gudtech/scamp-go
 
 go 1.26
 
-require golang.org/x/net v0.38.0
-
-require golang.org/x/sys v0.31.0 // indirect
+require (
+	golang.org/x/net v0.38.0
+	golang.org/x/sys v0.31.0
+)
@@ -1,5 +1,11 @@
 package scamp
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // ActionOptions struct that configuration options related to ticket verification
 // which are passed to Service.Register() function
 type ActionOptions struct {
@@ -7,6 +13,64 @@ type ActionOptions struct {
 	Privs  []int
 	// Location of the ticket_verify_public_key.pem
 	TicketVerifyPublicKey string
+	// Middleware runs around this action only, inside ticket verification and any
+	// middleware added with Service.Use
+	Middleware []Middleware
+	// MaxConcurrency limits how many calls of this action run at once across the
+	// whole service. Zero means no limit.
+	MaxConcurrency int
+	// Version of the action being registered; zero means 1
+	Version int
+	// CrudTags declares what the action does: read, create, update and/or destroy
+	CrudTags []string
+	// Flags are announced alongside the crud tags, e.g. FlagNoAuth
+	Flags []string
+	// Timeout is announced as a tNNN flag. Requesters that don't set a timeout of their
+	// own wait this long for the reply.
+	Timeout time.Duration
+	// Envelopes lists the envelopes the action accepts when it isn't just json
+	Envelopes []string
+	// Sector the action is offered in, if not the service's own. Requests don't say
+	// which sector they were addressed to, so an action name and version can only be
+	// registered in one sector per service.
+	Sector string
+}
+
+// CRUD tags accepted in ActionOptions.CrudTags
+const (
+	CrudRead    = "read"
+	CrudCreate  = "create"
+	CrudUpdate  = "update"
+	CrudDestroy = "destroy"
+)
+
+// tags builds the announced flags string from CrudTags and Flags
+func (options ActionOptions) tags() (tags string, err error) {
+	all := make([]string, 0, len(options.CrudTags)+len(options.Flags))
+	for _, tag := range options.CrudTags {
+		switch tag {
+		case CrudRead, CrudCreate, CrudUpdate, CrudDestroy:
+		default:
+			err = fmt.Errorf("unknown crud tag `%s`", tag)
+			return
+		}
+		all = append(all, tag)
+	}
+
+	for _, flag := range options.Flags {
+		if strings.ContainsAny(flag, ", ") || len(flag) == 0 {
+			err = fmt.Errorf("bad action flag `%s`", flag)
+			return
+		}
+		all = append(all, flag)
+	}
+
+	if options.Timeout > 0 {
+		all = append(all, timeoutFlag(options.Timeout))
+	}
+
+	tags = strings.Join(all, ",")
+	return
 }
 
 // DefaultActionOptions initializes and returns an ActionOptions struct with default nil values
@@ -29,21 +93,7 @@ type ServiceOptionsFunc struct {
 // Call calls a registered service action and verifies scamp auth ticket and associated privs
 // if the options are not nil
 func (function ServiceOptionsFunc) Call(message *Message, client *Client) {
-	if function.options.Verify || len(function.options.Privs) > 0 {
-		ticket, err := VerifyTicket(message.Ticket, function.options.TicketVerifyPublicKey)
-		if err != nil {
-			ReplyOnError(message, client, "verification", err)
-			return
-		}
-
-		err = ticket.CheckPrivs(function.options.Privs)
-		if err != nil {
-			ReplyOnError(message, client, "verification", err)
-			return
-		}
-	}
-
-	function.callback.Call(message, client)
+	VerifyTicketMiddleware(function.options)(function.callback).Call(message, client)
 }
 
 // ReplyOnError simplifies responding to scamp requests with an error state
@@ -63,10 +113,13 @@ func ReplyOnError(message *Message, client *Client, errorCode string, err error)
 		return
 	}
 
+	_, errorText := errorReplyFields(err)
+
 	respMsg := NewResponseMessage()
+	respMsg.SetEnvelope(message.Envelope)
 	respMsg.SetRequestID(message.RequestID)
 	respMsg.SetErrorCode(errorCode)
-	respMsg.SetError(err.Error())
+	respMsg.SetError(errorText)
 
 	_, clientErr := client.Send(respMsg)
 	if clientErr != nil {
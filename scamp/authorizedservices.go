@@ -1,56 +1,102 @@
 package scamp
 
-// import "fmt"
-import "errors"
-import "bufio"
-import "bytes"
-
-// AuthorizedServiceSpec contains service's fingerprint and registered actions
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authorizeAllActions is the action pattern that authorizes every action in a sector,
+// as in `web:ALL`
+const authorizeAllActions = "all"
+
+// AuthorizedServiceSpec contains a service certificate's fingerprint and the actions it
+// may offer
 type AuthorizedServiceSpec struct {
 	Fingerprint []byte
-	Actions     []serviceProxyClass
+	Actions     []AuthorizedActionPattern
+}
+
+// AuthorizedActionPattern is one entry of an authorized_services line. Sector defaults
+// to main. Action is lowercased and matches actions it is a dotted prefix of, every
+// action when it is ALL, or as a glob when it contains `*`.
+type AuthorizedActionPattern struct {
+	Sector string
+	Action string
+}
+
+// Matches reports whether the pattern authorizes action (`Class.action`) in sector
+func (pattern AuthorizedActionPattern) Matches(sector, action string) bool {
+	if !strings.EqualFold(pattern.Sector, sector) {
+		return false
+	}
+
+	action = strings.ToLower(action)
+	if pattern.Action == authorizeAllActions {
+		return true
+	} else if strings.Contains(pattern.Action, "*") {
+		matched, _ := path.Match(pattern.Action, action)
+		return matched
+	}
+	return action == pattern.Action || strings.HasPrefix(action, pattern.Action+".")
 }
 
-// AuthorizedServicesCache contains array of service's AuthorizedServiceSpec
+// Authorizes reports whether any of the spec's patterns authorize action in sector
+func (spec *AuthorizedServiceSpec) Authorizes(sector, action string) bool {
+	for _, pattern := range spec.Actions {
+		if pattern.Matches(sector, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizedServicesCache holds the specs from an authorized_services file by
+// fingerprint
 type AuthorizedServicesCache struct {
-	services []AuthorizedServiceSpec
+	services map[string]*AuthorizedServiceSpec
 }
 
-// NewAuthorizedServicesCache Initializes amd returns a pointesr to a new AuthorizedServicesCache
+// NewAuthorizedServicesCache Initializes and returns a pointer to a new AuthorizedServicesCache
 func NewAuthorizedServicesCache() (cache *AuthorizedServicesCache) {
 	cache = new(AuthorizedServicesCache)
-	cache.services = make([]AuthorizedServiceSpec, 100)
+	cache.services = make(map[string]*AuthorizedServiceSpec)
 
 	return
 }
 
-// LoadAuthorizedServices calls NewAuthorizedServicesCache() if *bufio.Scanner bytes are > 0
+// LoadAuthorizedServices adds a spec for every line read from s. Blank lines, comments
+// and lines that don't parse are skipped.
 func (cache *AuthorizedServicesCache) LoadAuthorizedServices(s *bufio.Scanner) (err error) {
-	var read bool
-	count := 1
-
-	for {
-		read = s.Scan()
-
-		if !read {
-			break
-			// Skip empty lines
-		} else if len(s.Bytes()) == 0 {
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
 
-		_, err = NewAuthorizedServicesSpec(s.Bytes())
-		if err != nil {
-			// Trace.Printf("Error creating AuthorizedServicesCache: %s", err)
+		spec, specErr := NewAuthorizedServicesSpec(line)
+		if specErr != nil {
+			Error.Printf("skipping authorized service: %s", specErr)
+			continue
 		}
-
-		count = count + 1
+		cache.services[strings.ToUpper(string(spec.Fingerprint))] = spec
 	}
 
-	return
+	return s.Err()
+}
+
+// Lookup returns the spec for a certificate fingerprint, or nil if it is not authorized
+func (cache *AuthorizedServicesCache) Lookup(fingerprint string) *AuthorizedServiceSpec {
+	return cache.services[strings.ToUpper(fingerprint)]
 }
 
-// NewAuthorizedServicesSpec returns a pointer to an AuthorizedServiceSpec which contains the service's fingerprint and svailable actions
+// NewAuthorizedServicesSpec returns a pointer to an AuthorizedServiceSpec which contains the service's fingerprint and available actions
 func NewAuthorizedServicesSpec(line []byte) (spec *AuthorizedServiceSpec, err error) {
 	s := bufio.NewScanner(bytes.NewReader(line))
 	s.Split(bufio.ScanWords)
@@ -64,20 +110,74 @@ func NewAuthorizedServicesSpec(line []byte) (spec *AuthorizedServiceSpec, err er
 	spec = new(AuthorizedServiceSpec)
 	spec.Fingerprint = make([]byte, len(s.Bytes()))
 	copy(spec.Fingerprint, s.Bytes())
-	spec.Actions = make([]serviceProxyClass, 100) //TODO: do a better job allocating here
-
-	index := 0
-	var read bool
-	for {
-		read = s.Scan()
-		if !read {
-			break
+
+	for s.Scan() {
+		// patterns are separated by commas as well as spaces
+		for _, token := range strings.Split(s.Text(), ",") {
+			if len(token) == 0 {
+				continue
+			}
+
+			pattern := AuthorizedActionPattern{Sector: "main", Action: strings.ToLower(token)}
+			if sector, action, found := strings.Cut(pattern.Action, ":"); found {
+				pattern.Sector, pattern.Action = sector, action
+			}
+			if len(pattern.Sector) == 0 || len(pattern.Action) == 0 {
+				err = fmt.Errorf("invalid action pattern `%s` for %s", token, spec.Fingerprint)
+				return
+			}
+			spec.Actions = append(spec.Actions, pattern)
 		}
+	}
+
+	return
+}
+
+// authorizedServicesFile loads the file named by bus.authorized_services and reloads it
+// when it changes
+var authorizedServicesFile struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	cache   *AuthorizedServicesCache
+}
+
+// defaultAuthorizedServices returns the authorized services from the default config, or
+// nil when none are configured, in which case every signed announcement is trusted
+func defaultAuthorizedServices() (cache *AuthorizedServicesCache, err error) {
+	if defaultConfig == nil {
+		return
+	}
+	authPath, found := defaultConfig.Get("bus.authorized_services")
+	if !found || len(authPath) == 0 {
+		return
+	}
+
+	file := &authorizedServicesFile
+	file.Lock()
+	defer file.Unlock()
+
+	stat, err := os.Stat(authPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read authorized services: %s", err)
+	}
+	if file.cache != nil && file.path == authPath && stat.ModTime().Equal(file.modTime) && stat.Size() == file.size {
+		return file.cache, nil
+	}
+
+	handle, err := os.Open(authPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read authorized services: %s", err)
+	}
+	defer handle.Close()
 
-		// spec.Actions[index].className = make([]byte, len(s.Bytes()))
-		spec.Actions[index].className = string(s.Bytes())
-		index = index + 1
+	cache = NewAuthorizedServicesCache()
+	err = cache.LoadAuthorizedServices(bufio.NewScanner(handle))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load `%s`: %s", authPath, err)
 	}
 
+	file.path, file.modTime, file.size, file.cache = authPath, stat.ModTime(), stat.Size(), cache
 	return
 }
@@ -3,7 +3,13 @@ package scamp
 import (
 	"bufio"
 	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAuthorizedServiceSpec(t *testing.T) {
@@ -54,3 +60,144 @@ var testAuthorizedServices = []byte(`
 06:28:FF:2D:85:4D:27:7F:30:39:4D:D1:3C:5A:28:C3:22:2A:85:BD config, constant, feed, device, inventory, media, nav, notes, po, product, receive, user, customer, utility, fulfillment, index, api, web:ALL, reporting, vendor, secproxy, bgdispatcher
 F9:08:C3:66:74:C4:26:76:09:15:A5:0C:CC:25:FF:63:E6:FA:F2:AC auth, user, background:ALL,  compute:ALL, soapoffload:ALL, channelmodule:ALL
 `)
+
+func TestAuthorizedActionPatterns(t *testing.T) {
+	spec, err := NewAuthorizedServicesSpec([]byte(`AB:CD product, web:ALL,Auth.getAuthzTable background:job.*`))
+	if err != nil {
+		t.Fatalf("error parsing service spec: `%s`", err)
+	}
+
+	cases := []struct {
+		sector, action string
+		authorized     bool
+	}{
+		{"main", "Product.get", true},
+		{"main", "product.sku.fetch", true},
+		{"main", "Productivity.get", false},
+		{"web", "Anything.atAll", true},
+		{"main", "Auth.getAuthzTable", true},
+		{"main", "Auth.login", false},
+		{"background", "Job.run", true},
+		{"background", "Product.get", false},
+		{"web2", "Anything.atAll", false},
+	}
+	for _, c := range cases {
+		if spec.Authorizes(c.sector, c.action) != c.authorized {
+			t.Errorf("%s:%s: expected authorized=%v", c.sector, c.action, c.authorized)
+		}
+	}
+}
+
+func TestValidateEnforcesAuthorizedServices(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	serv.Register("Secret.action", func(*Message, *Client) {}, nil)
+	serv.Register("Logging.info", func(*Message, *Client) {}, &ActionOptions{Version: 2, Sector: "background"})
+	announcement := announcementOf(t, serv)
+
+	block, _ := pem.Decode(serv.pemCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse cert: %s", err)
+	}
+
+	previous := defaultConfig
+	defer func() { defaultConfig = previous }()
+	conf := NewConfig()
+	defaultConfig = conf
+
+	validate := func() (*serviceProxy, error) {
+		instance, err := parseAnnouncement(announcement)
+		if err != nil {
+			t.Fatalf("parse announcement: %s", err)
+		}
+		return instance, instance.Validate()
+	}
+
+	// nothing configured: every signed announcement is trusted
+	instance, err := validate()
+	if err != nil || len(instance.classes) != 2 {
+		t.Fatalf("expected an unfiltered instance, got %+v (%v)", instance.classes, err)
+	}
+
+	authPath := filepath.Join(t.TempDir(), "authorized_services")
+	conf.Set("bus.authorized_services", authPath)
+	os.WriteFile(authPath, []byte("00:11:22 secret\n"), 0644)
+	_, err = validate()
+	if err == nil {
+		t.Fatalf("an unlisted certificate should be rejected")
+	}
+
+	os.WriteFile(authPath, []byte("# comment\n"+strings.ToLower(sha1FingerPrint(cert))+" logging,\n"), 0644)
+	os.Chtimes(authPath, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	instance, err = validate()
+	if err != nil {
+		t.Fatalf("a listed certificate should be accepted: %s", err)
+	}
+	if len(instance.classes) != 1 || len(instance.classes[0].actions) != 1 ||
+		instance.classes[0].className != "Logging" || instance.classes[0].actions[0].version != 1 {
+		t.Errorf("only main:Logging.info~1 should be left, got %+v", instance.classes)
+	}
+
+	cache := NewMemoryServiceCache()
+	cache.Store(instance)
+	if actions := cache.ActionList(); len(actions) != 1 {
+		t.Errorf("unauthorized actions reached the action index: %v", actions)
+	}
+}
+
+func TestRefreshRevalidatesWhenAuthorizedServicesChange(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	serv.Register("Secret.action", func(*Message, *Client) {}, nil)
+	fingerprint, err := pemFingerPrint(serv.pemCert)
+	if err != nil {
+		t.Fatalf("fingerprint: %s", err)
+	}
+
+	previous := defaultConfig
+	defer func() { defaultConfig = previous }()
+	defaultConfig = NewConfig()
+	dir := t.TempDir()
+	authPath := filepath.Join(dir, "authorized_services")
+	defaultConfig.Set("bus.authorized_services", authPath)
+	os.WriteFile(authPath, []byte(fingerprint+" logging, secret\n"), 0644)
+
+	cachePath := filepath.Join(dir, "discovery.cache")
+	writeCacheFile(t, cachePath, announcementOf(t, serv))
+	cache, err := NewServiceCache(cachePath)
+	if err != nil || len(cache.ActionList()) != 2 {
+		t.Fatalf("expected both actions, got %v (%v)", cache.ActionList(), err)
+	}
+
+	// the cache file is untouched, but Secret is no longer authorized
+	os.WriteFile(authPath, []byte(fingerprint+" logging\n"), 0644)
+	os.Chtimes(authPath, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	err = cache.Refresh()
+	if actions := cache.ActionList(); err != nil || len(actions) != 1 || !strings.HasPrefix(actions[0], "main:logging.info") {
+		t.Errorf("expected only Logging.info to be left, got %v (%v)", actions, err)
+	}
+}
+
+func TestFilterActionsLeavesOtherCopiesAlone(t *testing.T) {
+	instance := &serviceProxy{sector: "main", classes: []serviceProxyClass{
+		{className: "Secret", actions: []actionDescription{{actionName: "action", version: 1}}},
+		{className: "Logging", actions: []actionDescription{{actionName: "info", version: 1}}},
+	}}
+	// a second instance sharing the classes, as an identical announcement parsed into
+	// the same backing array would
+	copied := &serviceProxy{sector: instance.sector, classes: instance.classes}
+
+	spec, err := NewAuthorizedServicesSpec([]byte("00:11:22 logging"))
+	if err != nil {
+		t.Fatalf("spec: %s", err)
+	}
+	copied.filterActions(spec)
+
+	if len(copied.classes) != 1 || copied.classes[0].className != "Logging" {
+		t.Errorf("expected only Logging to be kept, got %+v", copied.classes)
+	}
+	if len(instance.classes) != 2 || instance.classes[0].className != "Secret" {
+		t.Errorf("filtering a copy changed the original: %+v", instance.classes)
+	}
+}
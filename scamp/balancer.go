@@ -0,0 +1,241 @@
+package scamp
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	u "net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Candidate is an instance of an action as seen by a Balancer
+type Candidate interface {
+	// Ident is the instance's unique name
+	Ident() string
+	// Weight is the announced weight, always at least 1: instances announcing zero are
+	// going away and are removed from the cache
+	Weight() int
+	// Outstanding counts requests sent to the instance that are still awaiting a reply
+	Outstanding() int
+	// ConnSpec is the address the instance announced
+	ConnSpec() string
+}
+
+// Balancer decides the order in which the instances of an action are tried. The first
+// instance is preferred; the others are fallbacks used when it can't be reached.
+// Implementations must return a new slice holding the same candidates, and leave
+// candidates untouched.
+type Balancer interface {
+	Order(candidates []Candidate) []Candidate
+}
+
+// orderInstances runs balancer over instances. Candidates a balancer invents or drops
+// are ignored; dropped instances are not tried.
+func orderInstances(balancer Balancer, instances []*serviceProxy) []*serviceProxy {
+	candidates := make([]Candidate, len(instances))
+	for i, instance := range instances {
+		candidates[i] = instance
+	}
+
+	ordered := make([]*serviceProxy, 0, len(instances))
+	seen := make(map[*serviceProxy]bool, len(instances))
+	for _, candidate := range balancer.Order(candidates) {
+		instance, ok := candidate.(*serviceProxy)
+		if ok && !seen[instance] {
+			seen[instance] = true
+			ordered = append(ordered, instance)
+		}
+	}
+	return ordered
+}
+
+// DefaultBalancer is used by requesters that don't set their own Balancer
+var DefaultBalancer Balancer = NewLeastOutstandingBalancer()
+
+func shuffled(candidates []Candidate) []Candidate {
+	ordered := make([]Candidate, len(candidates))
+	copy(ordered, candidates)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	return ordered
+}
+
+type weightedRandomBalancer struct{}
+
+// NewWeightedRandomBalancer orders instances randomly, in proportion to their announced
+// weight
+func NewWeightedRandomBalancer() Balancer {
+	return weightedRandomBalancer{}
+}
+
+func (weightedRandomBalancer) Order(candidates []Candidate) []Candidate {
+	// Efraimidis-Spirakis: sorting by rand^(1/weight) is a weighted shuffle
+	keys := make(map[Candidate]float64, len(candidates))
+	for _, candidate := range candidates {
+		keys[candidate] = math.Pow(rand.Float64(), 1/float64(candidate.Weight()))
+	}
+
+	ordered := shuffled(candidates)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i]] > keys[ordered[j]]
+	})
+	return ordered
+}
+
+type leastOutstandingBalancer struct{}
+
+// NewLeastOutstandingBalancer prefers the instances with the fewest requests awaiting
+// a reply on their connection. Ties are broken randomly.
+func NewLeastOutstandingBalancer() Balancer {
+	return leastOutstandingBalancer{}
+}
+
+func (leastOutstandingBalancer) Order(candidates []Candidate) []Candidate {
+	ordered := shuffled(candidates)
+
+	outstanding := make(map[Candidate]int, len(ordered))
+	for _, candidate := range ordered {
+		outstanding[candidate] = candidate.Outstanding()
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return outstanding[ordered[i]] < outstanding[ordered[j]]
+	})
+	return ordered
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+// NewRoundRobinBalancer rotates through the instances of an action, one per request
+func NewRoundRobinBalancer() Balancer {
+	return new(roundRobinBalancer)
+}
+
+func (balancer *roundRobinBalancer) Order(candidates []Candidate) []Candidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// the cache makes no ordering promises, so rotate over a stable order
+	sorted := make([]Candidate, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Ident() < sorted[j].Ident()
+	})
+
+	start := int(atomic.AddUint64(&balancer.next, 1) % uint64(len(sorted)))
+	return append(sorted[start:], sorted[:start]...)
+}
+
+type powerOfTwoBalancer struct{}
+
+// NewPowerOfTwoBalancer picks two instances at random and prefers the one with fewer
+// outstanding requests. The remaining instances follow in random order.
+func NewPowerOfTwoBalancer() Balancer {
+	return powerOfTwoBalancer{}
+}
+
+func (powerOfTwoBalancer) Order(candidates []Candidate) []Candidate {
+	ordered := shuffled(candidates)
+	if len(ordered) >= 2 && ordered[1].Outstanding() < ordered[0].Outstanding() {
+		ordered[0], ordered[1] = ordered[1], ordered[0]
+	}
+	return ordered
+}
+
+type localityBalancer struct {
+	next Balancer
+}
+
+// NewLocalityBalancer prefers instances on this host, then instances on a directly
+// attached subnet, then everything else. Within each group the order comes from next
+// (DefaultBalancer if nil).
+func NewLocalityBalancer(next Balancer) Balancer {
+	return localityBalancer{next: next}
+}
+
+const (
+	localityHost = iota
+	localitySubnet
+	localityRemote
+)
+
+func (balancer localityBalancer) Order(candidates []Candidate) []Candidate {
+	next := balancer.next
+	if next == nil {
+		next = DefaultBalancer
+	}
+
+	var tiers [localityRemote + 1][]Candidate
+	for _, candidate := range candidates {
+		tier := locality(candidate.ConnSpec())
+		tiers[tier] = append(tiers[tier], candidate)
+	}
+
+	ordered := make([]Candidate, 0, len(candidates))
+	for _, tier := range tiers {
+		if len(tier) > 0 {
+			ordered = append(ordered, next.Order(tier)...)
+		}
+	}
+	return ordered
+}
+
+var (
+	localNetworksOnce sync.Once
+	localNetworks     []*net.IPNet
+)
+
+// interfaceNetworks lists the addresses assigned to this host. Looked up once per process.
+func interfaceNetworks() []*net.IPNet {
+	localNetworksOnce.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			Error.Printf("could not list interface addresses: %s", err)
+			return
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				localNetworks = append(localNetworks, ipNet)
+			}
+		}
+	})
+
+	return localNetworks
+}
+
+// locality classifies the host of connspec relative to this host
+func locality(connspec string) int {
+	url, err := u.Parse(connspec)
+	if err != nil {
+		return localityRemote
+	}
+
+	ip := net.ParseIP(url.Hostname())
+	if ip == nil {
+		if url.Hostname() == "localhost" {
+			return localityHost
+		}
+		return localityRemote
+	}
+	if ip.IsLoopback() {
+		return localityHost
+	}
+
+	tier := localityRemote
+	for _, network := range interfaceNetworks() {
+		if network.IP.Equal(ip) {
+			return localityHost
+		}
+		if network.Contains(ip) {
+			tier = localitySubnet
+		}
+	}
+	return tier
+}
@@ -0,0 +1,106 @@
+package scamp
+
+import "testing"
+
+func balancerTestProxies() []*serviceProxy {
+	return []*serviceProxy{
+		&serviceProxy{ident: "a", weight: 1, connspec: "beepish+tls://203.0.113.10:30100"},
+		&serviceProxy{ident: "b", weight: 1, connspec: "beepish+tls://203.0.113.11:30100"},
+		&serviceProxy{ident: "c", weight: 20, connspec: "beepish+tls://127.0.0.1:30100"},
+	}
+}
+
+func balancerTestCandidates() []Candidate {
+	proxies := balancerTestProxies()
+	candidates := make([]Candidate, len(proxies))
+	for i, proxy := range proxies {
+		candidates[i] = proxy
+	}
+	return candidates
+}
+
+func TestBalancersKeepCandidates(t *testing.T) {
+	balancers := map[string]Balancer{
+		"weighted":    NewWeightedRandomBalancer(),
+		"outstanding": NewLeastOutstandingBalancer(),
+		"roundrobin":  NewRoundRobinBalancer(),
+		"p2c":         NewPowerOfTwoBalancer(),
+		"locality":    NewLocalityBalancer(nil),
+	}
+
+	for name, balancer := range balancers {
+		candidates := balancerTestCandidates()
+		ordered := balancer.Order(candidates)
+		if len(ordered) != len(candidates) {
+			t.Fatalf("%s: expected %d instances, got %d", name, len(candidates), len(ordered))
+		}
+
+		seen := make(map[string]bool)
+		for _, candidate := range ordered {
+			seen[candidate.Ident()] = true
+		}
+		if len(seen) != len(candidates) {
+			t.Errorf("%s: instances were dropped or duplicated", name)
+		}
+		if candidates[0].Ident() != "a" || candidates[2].Ident() != "c" {
+			t.Errorf("%s: candidates slice was modified", name)
+		}
+	}
+}
+
+func TestWeightedRandomBalancerPrefersHeavierInstances(t *testing.T) {
+	balancer := NewWeightedRandomBalancer()
+	first := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		first[balancer.Order(balancerTestCandidates())[0].Ident()]++
+	}
+	// c should come first about 20 times in 22
+	if first["c"] < 150 {
+		t.Errorf("expected the heavier instance to be preferred, got %v", first)
+	}
+}
+
+// fakeCandidate is a Candidate that is not a cached instance
+type fakeCandidate struct{ ident string }
+
+func (candidate fakeCandidate) Ident() string    { return candidate.ident }
+func (candidate fakeCandidate) Weight() int      { return 1 }
+func (candidate fakeCandidate) Outstanding() int { return 0 }
+func (candidate fakeCandidate) ConnSpec() string { return "" }
+
+// reversingBalancer reverses the candidates, drops the last one and adds a stranger
+type reversingBalancer struct{}
+
+func (reversingBalancer) Order(candidates []Candidate) []Candidate {
+	ordered := []Candidate{fakeCandidate{"stranger"}}
+	for i := len(candidates) - 1; i > 0; i-- {
+		ordered = append(ordered, candidates[i])
+	}
+	return ordered
+}
+
+func TestOrderInstancesIgnoresForeignCandidates(t *testing.T) {
+	ordered := orderInstances(reversingBalancer{}, balancerTestProxies())
+	if len(ordered) != 2 || ordered[0].ident != "c" || ordered[1].ident != "b" {
+		t.Errorf("expected c then b, got %v", ordered)
+	}
+}
+
+func TestRoundRobinBalancerRotates(t *testing.T) {
+	balancer := NewRoundRobinBalancer()
+	first := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		first[balancer.Order(balancerTestCandidates())[0].Ident()] = true
+	}
+	if len(first) != 3 {
+		t.Errorf("expected every instance to be preferred once, got %v", first)
+	}
+}
+
+func TestLocalityBalancerPrefersLocalhost(t *testing.T) {
+	initSCAMPLogger()
+	ordered := NewLocalityBalancer(NewRoundRobinBalancer()).Order(balancerTestCandidates())
+	if ordered[0].Ident() != "c" {
+		t.Errorf("expected loopback instance first, got %s", ordered[0].Ident())
+	}
+}
@@ -0,0 +1,235 @@
+package scamp
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker kept for one service instance
+type BreakerState int
+
+const (
+	// BreakerClosed instances take traffic normally
+	BreakerClosed BreakerState = iota
+	// BreakerOpen instances are ejected until their cooldown passes
+	BreakerOpen
+	// BreakerHalfOpen instances are being probed by a single request
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerOptions configures when instances are ejected and for how long
+type BreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures (dial errors, send errors,
+	// timeouts, lost connections and error replies) that trips the breaker. Zero disables
+	// ejection.
+	FailureThreshold int
+	// Cooldown is how long a tripped instance is ejected before a probe request is let through
+	Cooldown time.Duration
+}
+
+// DefaultBreakerOptions returns the options used by DefaultBreakers
+func DefaultBreakerOptions() BreakerOptions {
+	return BreakerOptions{
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// BreakerStatus is a snapshot of one instance's breaker, for dashboards
+type BreakerStatus struct {
+	Ident               string       `json:"ident"`
+	State               BreakerState `json:"-"`
+	StateName           string       `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            time.Time    `json:"opened_at,omitempty"`
+	LastError           string       `json:"last_error,omitempty"`
+}
+
+type circuitBreaker struct {
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	lastError string
+}
+
+// BreakerRegistry tracks the health of service instances by ident. Healthy instances
+// are not stored, so the registry only holds instances that have failed recently.
+type BreakerRegistry struct {
+	breakersM sync.Mutex
+	breakers  map[string]*circuitBreaker
+	options   BreakerOptions
+}
+
+// NewBreakerRegistry returns an empty registry using options
+func NewBreakerRegistry(options BreakerOptions) *BreakerRegistry {
+	return &BreakerRegistry{
+		breakers: make(map[string]*circuitBreaker),
+		options:  options,
+	}
+}
+
+// DefaultBreakers is used by requesters that don't set their own registry
+var DefaultBreakers = NewBreakerRegistry(DefaultBreakerOptions())
+
+// ejected reports whether ident should be kept out of rotation right now
+func (registry *BreakerRegistry) ejected(ident string) bool {
+	registry.breakersM.Lock()
+	defer registry.breakersM.Unlock()
+
+	breaker, ok := registry.breakers[ident]
+	if !ok {
+		return false
+	}
+
+	switch breaker.state {
+	case BreakerOpen:
+		return time.Since(breaker.openedAt) < registry.options.Cooldown
+	case BreakerHalfOpen:
+		return breaker.probing
+	}
+	return false
+}
+
+// begin is called before a request is sent to ident. An open breaker whose cooldown has
+// passed moves to half-open and the request becomes its probe.
+func (registry *BreakerRegistry) begin(ident string) {
+	registry.breakersM.Lock()
+	defer registry.breakersM.Unlock()
+
+	breaker, ok := registry.breakers[ident]
+	if !ok {
+		return
+	}
+
+	if breaker.state == BreakerOpen && time.Since(breaker.openedAt) >= registry.options.Cooldown {
+		breaker.state = BreakerHalfOpen
+	}
+	if breaker.state == BreakerHalfOpen {
+		breaker.probing = true
+	}
+}
+
+// record notes the outcome of a request to ident. A nil err closes the breaker.
+// Cancellation by the caller says nothing about the instance and is ignored.
+func (registry *BreakerRegistry) record(ident string, err error) {
+	if len(ident) == 0 {
+		return
+	}
+
+	registry.breakersM.Lock()
+	defer registry.breakersM.Unlock()
+
+	if err == nil {
+		delete(registry.breakers, ident)
+		return
+	}
+
+	breaker, ok := registry.breakers[ident]
+	if errors.Is(err, context.Canceled) {
+		if ok {
+			breaker.probing = false
+		}
+		return
+	}
+
+	if registry.options.FailureThreshold <= 0 {
+		return
+	}
+
+	if !ok {
+		registry.sweepNoLock()
+		breaker = new(circuitBreaker)
+		registry.breakers[ident] = breaker
+	}
+
+	breaker.failures++
+	breaker.lastError = err.Error()
+
+	if breaker.state == BreakerHalfOpen || breaker.failures >= registry.options.FailureThreshold {
+		if breaker.state != BreakerOpen {
+			Error.Printf("ejecting %s for %s after %d consecutive failures: %s", ident, registry.options.Cooldown, breaker.failures, err)
+		}
+		breaker.state = BreakerOpen
+		breaker.openedAt = time.Now()
+		breaker.probing = false
+	}
+}
+
+// sweepNoLock forgets instances that have been ejected for a long time without anyone
+// probing them; they have most likely left discovery.
+func (registry *BreakerRegistry) sweepNoLock() {
+	for ident, breaker := range registry.breakers {
+		if breaker.state == BreakerOpen && time.Since(breaker.openedAt) > 10*registry.options.Cooldown {
+			delete(registry.breakers, ident)
+		}
+	}
+}
+
+// Reset closes the breaker for ident
+func (registry *BreakerRegistry) Reset(ident string) {
+	registry.breakersM.Lock()
+	defer registry.breakersM.Unlock()
+
+	delete(registry.breakers, ident)
+}
+
+// States returns a snapshot of every instance with recent failures, sorted by ident
+func (registry *BreakerRegistry) States() (states []BreakerStatus) {
+	registry.breakersM.Lock()
+	defer registry.breakersM.Unlock()
+
+	states = make([]BreakerStatus, 0, len(registry.breakers))
+	for ident, breaker := range registry.breakers {
+		state := breaker.state
+		if state == BreakerOpen && time.Since(breaker.openedAt) >= registry.options.Cooldown {
+			// waiting for the next request to probe it
+			state = BreakerHalfOpen
+		}
+
+		states = append(states, BreakerStatus{
+			Ident:               ident,
+			State:               state,
+			StateName:           state.String(),
+			ConsecutiveFailures: breaker.failures,
+			OpenedAt:            breaker.openedAt,
+			LastError:           breaker.lastError,
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Ident < states[j].Ident
+	})
+	return
+}
+
+// partitionEjected moves ejected instances to the back of ordered. They are only tried
+// when nothing healthy could take the request.
+func (registry *BreakerRegistry) partitionEjected(ordered []*serviceProxy) []*serviceProxy {
+	healthy := make([]*serviceProxy, 0, len(ordered))
+	var ejected []*serviceProxy
+	for _, serviceProxy := range ordered {
+		if serviceProxy != nil && registry.ejected(serviceProxy.Ident()) {
+			ejected = append(ejected, serviceProxy)
+			continue
+		}
+		healthy = append(healthy, serviceProxy)
+	}
+
+	return append(healthy, ejected...)
+}
@@ -0,0 +1,70 @@
+package scamp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerTripsAndRecovers(t *testing.T) {
+	initSCAMPLogger()
+	registry := NewBreakerRegistry(BreakerOptions{FailureThreshold: 2, Cooldown: 20 * time.Millisecond})
+	failure := errors.New("connection refused")
+
+	registry.record("a", failure)
+	if registry.ejected("a") {
+		t.Fatalf("ejected before reaching the threshold")
+	}
+
+	registry.record("a", context.Canceled)
+	registry.record("a", failure)
+	if !registry.ejected("a") {
+		t.Fatalf("expected instance to be ejected after 2 failures")
+	}
+
+	states := registry.States()
+	if len(states) != 1 || states[0].State != BreakerOpen || states[0].LastError != failure.Error() {
+		t.Fatalf("unexpected breaker states: %+v", states)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if registry.ejected("a") {
+		t.Fatalf("expected instance to be probed after the cooldown")
+	}
+
+	registry.begin("a")
+	if !registry.ejected("a") {
+		t.Fatalf("only one probe should be in flight")
+	}
+
+	registry.record("a", nil)
+	if registry.ejected("a") || len(registry.States()) != 0 {
+		t.Fatalf("a successful probe should close the breaker")
+	}
+}
+
+func TestBreakerFailedProbeReopens(t *testing.T) {
+	initSCAMPLogger()
+	registry := NewBreakerRegistry(BreakerOptions{FailureThreshold: 1, Cooldown: 10 * time.Millisecond})
+
+	registry.record("a", errors.New("timeout"))
+	time.Sleep(15 * time.Millisecond)
+	registry.begin("a")
+	registry.record("a", errors.New("timeout"))
+
+	if !registry.ejected("a") {
+		t.Fatalf("a failed probe should eject the instance again")
+	}
+}
+
+func TestBreakerPartitionEjected(t *testing.T) {
+	initSCAMPLogger()
+	registry := NewBreakerRegistry(BreakerOptions{FailureThreshold: 1, Cooldown: time.Minute})
+	registry.record("a", errors.New("dial failed"))
+
+	ordered := registry.partitionEjected(balancerTestProxies())
+	if ordered[len(ordered)-1].ident != "a" || len(ordered) != 3 {
+		t.Errorf("expected ejected instance last")
+	}
+}
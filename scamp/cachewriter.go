@@ -0,0 +1,190 @@
+package scamp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// defaultCacheWriteDelay is how long a CacheWriter collects changes before writing, so
+// a burst of announcements costs one write
+const defaultCacheWriteDelay = 500 * time.Millisecond
+
+// WriteTo writes every instance in the cache file format that DoScan reads. Records are
+// written exactly as they were announced, since re-encoding them would break their
+// signatures; instances without a signed record (stored from a local Service) are
+// skipped.
+func (cache *ServiceCache) WriteTo(w io.Writer) (n int64, err error) {
+	cache.cacheM.RLock()
+	instances := make([]*serviceProxy, 0, len(cache.identIndex))
+	for _, instance := range cache.identIndex {
+		if len(instance.rawClassRecords) == 0 || len(instance.rawCert) == 0 || len(instance.rawSig) == 0 {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	cache.cacheM.RUnlock()
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ident < instances[j].ident
+	})
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, instance := range instances {
+		buf.Write(sep)
+		buf.Write(newline)
+		buf.Write(instance.rawClassRecords)
+		buf.WriteString("\n\n")
+		buf.Write(instance.rawCert)
+		buf.WriteString("\n\n")
+		buf.Write(instance.rawSig)
+		buf.WriteString("\n\n\n")
+	}
+	err = buf.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (counter *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = counter.w.Write(p)
+	counter.n += int64(n)
+	return
+}
+
+// shortestAnnounceInterval is the shortest interval any cached instance announces at,
+// or the default interval when the cache is empty
+func (cache *ServiceCache) shortestAnnounceInterval() (shortest time.Duration) {
+	cache.cacheM.RLock()
+	defer cache.cacheM.RUnlock()
+
+	shortest = time.Duration(defaultAnnounceInterval) * time.Second
+	for _, instance := range cache.identIndex {
+		if interval := instance.announcePeriod(); interval < shortest {
+			shortest = interval
+		}
+	}
+	return
+}
+
+// CacheWriter keeps a discovery cache file in line with a ServiceCache, typically one
+// filled by a DiscoveryListener, so that processes reading the file see the same
+// instances. It replaces the external cache daemon.
+type CacheWriter struct {
+	cache *ServiceCache
+	path  string
+	delay time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewCacheWriter creates a CacheWriter that writes cache to path
+func NewCacheWriter(cache *ServiceCache, path string) (writer *CacheWriter) {
+	writer = new(CacheWriter)
+	writer.cache = cache
+	writer.path = path
+	writer.delay = defaultCacheWriteDelay
+	writer.ctx, writer.cancel = context.WithCancel(context.Background())
+	return
+}
+
+// SetDelay sets how long changes are collected before the file is rewritten
+func (writer *CacheWriter) SetDelay(delay time.Duration) {
+	writer.delay = delay
+}
+
+// Write replaces the cache file with the current contents of the cache. The new file is
+// written next to the old one and renamed over it, so readers never see a partial file.
+func (writer *CacheWriter) Write() (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(writer.path), "."+filepath.Base(writer.path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = writer.cache.WriteTo(tmp)
+	if err != nil {
+		return
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		return
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), writer.path)
+}
+
+// Stop ends Run
+func (writer *CacheWriter) Stop() {
+	writer.cancel()
+}
+
+// Run writes the cache file once, then again whenever the cache changes, until Stop is
+// called. Re-announcements don't count as changes, so the file is also rewritten once per
+// announce interval to carry their timestamps; readers that sweep stale instances would
+// drop live ones otherwise.
+func (writer *CacheWriter) Run() {
+	writer.RunContext(writer.ctx)
+}
+
+// RunContext is Run that also returns when ctx is done
+func (writer *CacheWriter) RunContext(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+	unsubscribe := writer.cache.Subscribe(func(CacheEvent) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	for {
+		err := writer.Write()
+		if err != nil {
+			Error.Printf("write cache `%s`: %s", writer.path, err)
+		}
+
+		refresh := time.NewTimer(writer.cache.shortestAnnounceInterval())
+		select {
+		case <-ctx.Done():
+			refresh.Stop()
+			return
+		case <-writer.ctx.Done():
+			refresh.Stop()
+			return
+		case <-changed:
+			refresh.Stop()
+		case <-refresh.C:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-writer.ctx.Done():
+			return
+		case <-time.After(writer.delay):
+		}
+	}
+}
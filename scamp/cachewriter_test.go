@@ -0,0 +1,129 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCacheWriterRoundTripsFixtures(t *testing.T) {
+	initSCAMPLogger()
+	for _, fixture := range []string{"../fixtures/announce_cache", "../fixtures/sample_discovery_cache"} {
+		original := NewMemoryServiceCache()
+		original.DisableRecordVerification()
+		file, err := os.Open(fixture)
+		if err != nil {
+			t.Fatalf("open fixture: %s", err)
+		}
+		err = original.DoScan(bufio.NewScanner(file))
+		file.Close()
+		if err != nil || original.Size() == 0 {
+			t.Fatalf("%s: could not load fixture (%v)", fixture, err)
+		}
+
+		path := filepath.Join(t.TempDir(), "discovery.cache")
+		err = NewCacheWriter(original, path).Write()
+		if err != nil {
+			t.Fatalf("%s: write failed: %s", fixture, err)
+		}
+
+		reread, err := NewServiceCache(path)
+		if err != nil {
+			t.Fatalf("%s: written cache does not parse: %s", fixture, err)
+		}
+		if reread.Size() != original.Size() {
+			t.Errorf("%s: expected %d instances, got %d", fixture, original.Size(), reread.Size())
+		}
+		originalActions, rereadActions := original.ActionList(), reread.ActionList()
+		sort.Strings(originalActions)
+		sort.Strings(rereadActions)
+		if !reflect.DeepEqual(originalActions, rereadActions) {
+			t.Errorf("%s: actions changed in the round trip", fixture)
+		}
+
+		var first, second bytes.Buffer
+		original.WriteTo(&first)
+		reread.WriteTo(&second)
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%s: rewriting a written cache should be stable", fixture)
+		}
+
+		leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".discovery.cache.*"))
+		if len(leftovers) != 0 {
+			t.Errorf("%s: temporary files left behind: %v", fixture, leftovers)
+		}
+	}
+}
+
+func TestCacheWriterFollowsListener(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	listener, _, sender := newLoopbackListener(t)
+
+	path := filepath.Join(t.TempDir(), "discovery.cache")
+	writer := NewCacheWriter(listener.cache, path)
+	writer.SetDelay(time.Millisecond)
+	go writer.Run()
+	defer writer.Stop()
+
+	sender.Write(announcementOf(t, serv))
+
+	for i := 0; i < 200; i++ {
+		cache, err := NewServiceCache(path)
+		if err == nil && cache.Retrieve("announced-1234") != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the announced instance never reached the cache file")
+}
+
+func TestCacheWriterRefreshesTimestamps(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	serv.SetAnnounceInterval(500 * time.Millisecond)
+	listener, _, sender := newLoopbackListener(t)
+
+	path := filepath.Join(t.TempDir(), "discovery.cache")
+	writer := NewCacheWriter(listener.cache, path)
+	writer.SetDelay(time.Millisecond)
+	go writer.Run()
+	defer writer.Stop()
+
+	writtenAt := func() time.Time {
+		cache, err := NewServiceCache(path)
+		if err != nil {
+			return time.Time{}
+		}
+		if instance := cache.Retrieve("announced-1234"); instance != nil {
+			return instance.announcedAt()
+		}
+		return time.Time{}
+	}
+
+	sender.Write(announcementOf(t, serv))
+	var first time.Time
+	for i := 0; i < 200 && first.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		first = writtenAt()
+	}
+	if first.IsZero() {
+		t.Fatalf("the announced instance never reached the cache file")
+	}
+
+	// the re-announcement differs only in its timestamp
+	time.Sleep(10 * time.Millisecond)
+	sender.Write(announcementOf(t, serv))
+	for i := 0; i < 200; i++ {
+		if at := writtenAt(); !at.IsZero() && !at.Equal(first) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the cache file kept the first announcement's timestamp")
+}
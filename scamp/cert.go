@@ -5,6 +5,8 @@ import "strings"
 
 import "crypto/sha1"
 import "crypto/x509"
+import "encoding/pem"
+import "errors"
 
 // GetSHA1FingerPrint returns a sha1 hash fingerprint of the service's x509 certitifate
 func GetSHA1FingerPrint(cert *x509.Certificate) (hexSha1 string) {
@@ -29,3 +31,20 @@ func sha1FingerPrint(cert *x509.Certificate) (hexSha1 string) {
 
 	return
 }
+
+// pemFingerPrint returns the sha1 fingerprint of a PEM encoded certificate
+func pemFingerPrint(rawCert []byte) (hexSha1 string, err error) {
+	decoded, _ := pem.Decode(rawCert)
+	if decoded == nil {
+		err = errors.New("no PEM certificate found")
+		return
+	}
+
+	cert, err := x509.ParseCertificate(decoded.Bytes)
+	if err != nil {
+		return
+	}
+
+	hexSha1 = sha1FingerPrint(cert)
+	return
+}
@@ -1,6 +1,7 @@
 package scamp
 
 import (
+	"context"
 	"sync"
 )
 
@@ -18,6 +19,14 @@ type Client struct {
 	sendM           sync.Mutex
 	nextRequestID   int
 	spIdent         string
+	// proxy is the serviceProxy pooling this client; Close takes the client out of it
+	proxy  *serviceProxy
+	proxyM sync.Mutex
+	// fingerprint is that of the certificate the other end presented
+	fingerprint string
+	// ctx is cancelled once the connection closes or stops delivering messages
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // Dial calls DialConnection to establish a secure (tls) connection,
@@ -34,6 +43,29 @@ func Dial(connspec string) (client *Client, err error) {
 	return
 }
 
+// DialPinned is Dial that only accepts a server presenting the certificate with the
+// given sha1 fingerprint (see DialPinnedConnection)
+func DialPinned(connspec string, fingerprint string) (client *Client, err error) {
+	conn, err := DialPinnedConnection(connspec, fingerprint)
+	if err != nil {
+		return
+	}
+	client = NewClient(conn, "service-proxy")
+
+	return
+}
+
+// DialWithOptions is Dial with per-connection options (see DialConnectionWithOptions)
+func DialWithOptions(connspec string, options DialOptions) (client *Client, err error) {
+	conn, err := DialConnectionWithOptions(connspec, options)
+	if err != nil {
+		return
+	}
+	client = NewClient(conn, "service-proxy")
+
+	return
+}
+
 // NewClient takes a scamp connection and creates a new scamp client
 func NewClient(conn *Connection, clientType string) (client *Client) {
 	// Trace.Printf("client allocated")
@@ -42,6 +74,8 @@ func NewClient(conn *Connection, clientType string) (client *Client) {
 	client.conn = conn
 	client.requests = make(chan *Message)
 	client.openReplies = make(map[int]chan *Message)
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	client.fingerprint = conn.Fingerprint
 	// clientID++
 	// client.ID = clientID
 	// if len(clientType) > 0 {
@@ -53,11 +87,27 @@ func NewClient(conn *Connection, clientType string) (client *Client) {
 
 	// grNum++
 	// go client.splitReqsAndReps(grNum, clientID)
-	go client.splitReqsAndReps()
+	go client.splitReqsAndReps(conn.msgs)
 
 	return
 }
 
+// Context is done once the client's connection is closed or has failed. Handlers can
+// use it to stop work whose reply can no longer be delivered.
+func (client *Client) Context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
+// Fingerprint is the sha1 fingerprint of the certificate the other end of the connection
+// presented, or empty if it presented none. On a service's connections it identifies
+// the caller, when the service asks for client certificates (see Service.SetClientAuth).
+func (client *Client) Fingerprint() string {
+	return client.fingerprint
+}
+
 // SetService assigns a *Service to client.serv
 func (client *Client) SetService(serv *Service) {
 	client.serv = serv
@@ -70,17 +120,19 @@ func (client *Client) Send(msg *Message) (responseChan chan *Message, err error)
 	client.sendM.Lock()
 	defer client.sendM.Unlock()
 
-	client.nextRequestID++
-	msg.RequestID = client.nextRequestID
-	err = client.conn.Send(msg)
-	if err != nil {
-		// Trace.Printf("SCAMP send error: %s", err)
-		return
+	// Replies keep the ID of the request they answer; the requester matches on it, and
+	// replies may go out in a different order than their requests came in.
+	if msg.MessageType == MessageTypeRequest || msg.RequestID == 0 {
+		client.nextRequestID++
+		msg.RequestID = client.nextRequestID
 	}
 
+	// The reply slot is registered before the message goes out so a fast reply
+	// can't beat us to the map. It is buffered so splitReqsAndReps never blocks
+	// on a requester that has already given up waiting.
 	if msg.MessageType == MessageTypeRequest {
 		// Trace.Printf("sending request so waiting for reply")
-		responseChan = make(chan *Message)
+		responseChan = make(chan *Message, 1)
 		client.openRepliesLock.Lock()
 		client.openReplies[msg.RequestID] = responseChan
 		client.openRepliesLock.Unlock()
@@ -88,16 +140,67 @@ func (client *Client) Send(msg *Message) (responseChan chan *Message, err error)
 		// Trace.Printf("sending reply so done with this message")
 	}
 
+	err = client.conn.Send(msg)
+	if err != nil {
+		// Trace.Printf("SCAMP send error: %s", err)
+		if responseChan != nil {
+			client.cancelReply(msg.RequestID)
+			responseChan = nil
+		}
+		return
+	}
+
 	return
 }
 
+// cancelReply forgets the reply slot for requestID. Used when the requester
+// stops waiting (cancellation, timeout) so the slot doesn't linger in openReplies.
+func (client *Client) cancelReply(requestID int) {
+	client.openRepliesLock.Lock()
+	delete(client.openReplies, requestID)
+	client.openRepliesLock.Unlock()
+}
+
+// outstanding counts requests that are still waiting for a reply
+func (client *Client) outstanding() int {
+	client.openRepliesLock.Lock()
+	defer client.openRepliesLock.Unlock()
+	return len(client.openReplies)
+}
+
+// setProxy records the serviceProxy pooling client, so Close can take it out of the pool
+func (client *Client) setProxy(sp *serviceProxy) {
+	client.proxyM.Lock()
+	defer client.proxyM.Unlock()
+	client.proxy = sp
+	client.spIdent = sp.ident
+}
+
+// ident is the ident of the instance client was dialed for, if it came from a serviceProxy
+func (client *Client) ident() string {
+	client.proxyM.Lock()
+	defer client.proxyM.Unlock()
+	return client.spIdent
+}
+
+// closed reports whether Close has run
+func (client *Client) closed() bool {
+	client.closedM.Lock()
+	defer client.closedM.Unlock()
+	return client.isClosed
+}
+
 // Close unlocks a client mutex and closes the connection
 func (client *Client) Close() {
-	if len(client.spIdent) > 0 {
-		sp := DefaultCache.Retrieve(client.spIdent)
-		if sp != nil {
-			sp.client = nil
-		}
+	client.proxyM.Lock()
+	proxy := client.proxy
+	client.proxyM.Unlock()
+	if proxy != nil {
+		proxy.clearClient(client)
+	}
+
+	if client.cancel != nil {
+		client.cancel()
 	}
 
 	client.closedM.Lock()
@@ -121,23 +224,29 @@ func (client *Client) Close() {
 	client.isClosed = true
 }
 
-// closeConnection calls client.conn.Close() and sets the client.conn to nil
+// closeConnection calls client.conn.Close() and sets the client.conn to nil. The
+// connection is closed before waiting on sendM, which unblocks a Send stuck writing to it.
 func (client *Client) closeConnection(conn *Connection) {
-	if !client.conn.isClosed {
-		client.conn.Close()
+	if conn != nil {
+		conn.Close()
 	}
+
+	client.sendM.Lock()
 	client.conn = nil
+	client.sendM.Unlock()
 }
 
 //func (client *Client) splitReqsAndReps(grNum, clientID int) (err error) {
-func (client *Client) splitReqsAndReps() (err error) {
+// msgs is passed in because Close clears client.conn, possibly before this goroutine
+// first gets to look at it
+func (client *Client) splitReqsAndReps(msgs chan *Message) (err error) {
 	var replyChan chan *Message
 
 forLoop:
 	for {
 		// Trace.Printf("Entering forLoop splitReqsAndReps")
 		select {
-		case message, ok := <-client.conn.msgs:
+		case message, ok := <-msgs:
 			if !ok {
 				// Trace.Printf("client.conn.msgs... CLOSED!")
 				break forLoop
@@ -173,13 +282,15 @@ forLoop:
 	}
 
 	// Trace.Printf("done with SplitReqsAndReps")
+	// nothing more will be read, so handlers still running can't be heard from
+	client.cancel()
 	close(client.requests)
 	client.openRepliesLock.Lock()
 	for _, openReplyChan := range client.openReplies {
 		close(openReplyChan)
 	}
 	client.openRepliesLock.Unlock()
-	if !client.isClosed {
+	if !client.closed() {
 		client.Close()
 	}
 
@@ -3,6 +3,8 @@ package scamp
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -31,10 +33,37 @@ type Connection struct {
 	scampDebugger  *scampDebugger
 }
 
+// DialOptions tune a connection made with DialConnectionWithOptions
+type DialOptions struct {
+	// Fingerprint, when set, fails the handshake with a VerificationError unless the
+	// server presents the certificate with this sha1 fingerprint
+	Fingerprint string
+	// Certificate, when set, is presented to services that ask for a client
+	// certificate (see Service.SetClientAuth). A service usually presents its own
+	// keypair (Service.Certificate).
+	Certificate *tls.Certificate
+}
+
 // DialConnection Used by Client to establish a secure connection to the remote service.
-// TODO: You must use the *connection.Fingerprint to verify the
-// remote host
+// The server's certificate is not checked; use DialPinnedConnection when the expected
+// certificate is known.
 func DialConnection(connspec string) (conn *Connection, err error) {
+	return DialConnectionWithOptions(connspec, DialOptions{})
+}
+
+// DialPinnedConnection is DialConnection that fails the handshake with a
+// VerificationError unless the server presents the certificate with the given sha1
+// fingerprint, as announced in discovery
+func DialPinnedConnection(connspec string, fingerprint string) (conn *Connection, err error) {
+	if len(fingerprint) == 0 {
+		err = errors.New("no fingerprint to pin the connection to")
+		return
+	}
+	return DialConnectionWithOptions(connspec, DialOptions{Fingerprint: fingerprint})
+}
+
+// DialConnectionWithOptions is DialConnection with per-connection options
+func DialConnectionWithOptions(connspec string, options DialOptions) (conn *Connection, err error) {
 	// Trace.Printf("Dialing connection to `%s`", connspec)
 
 	// Build cipher suite list from the current defaults plus RSA key exchange AES suites.
@@ -52,10 +81,18 @@ func DialConnection(connspec string) (conn *Connection, err error) {
 		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 	)
 
+	// service certificates are self-signed, so they are pinned rather than verified
+	// against a CA
 	config := &tls.Config{
 		InsecureSkipVerify: true,
 		CipherSuites:       cipherSuites,
 	}
+	if len(options.Fingerprint) > 0 {
+		config.VerifyPeerCertificate = pinnedCertificate(options.Fingerprint)
+	}
+	if options.Certificate != nil {
+		config.Certificates = []tls.Certificate{*options.Certificate}
+	}
 	config.BuildNameToCertificate() //nolint:staticcheck // deprecated no-op, preserved to minimise diff
 
 	tlsConn, err := tls.Dial("tcp", connspec, config)
@@ -67,7 +104,27 @@ func DialConnection(connspec string) (conn *Connection, err error) {
 	return
 }
 
-// NewConnection Used by Service
+// pinnedCertificate checks that the peer's leaf certificate has the given fingerprint
+func pinnedCertificate(fingerprint string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return &VerificationError{Err: errors.New("server presented no certificate")}
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return &VerificationError{Err: fmt.Errorf("server certificate: %s", err)}
+		}
+
+		presented := sha1FingerPrint(cert)
+		if !strings.EqualFold(presented, fingerprint) {
+			return &VerificationError{Err: fmt.Errorf("server certificate %s does not match the announced %s", presented, fingerprint)}
+		}
+		return nil
+	}
+}
+
+// NewConnection Used by Service. Fingerprint is only set when tlsConn has completed its
+// handshake.
 func NewConnection(tlsConn *tls.Conn, connType string) (conn *Connection) {
 	conn = new(Connection)
 	conn.conn = tlsConn
@@ -237,6 +294,8 @@ func (conn *Connection) routePacket(pkt *Packet) (err error) {
 		} else {
 			msg.Error = "There was an unkown error with the connection"
 		}
+		msg.ErrorCode = ErrorCodeTransport
+		msg.transportError = true
 		msg.Write(pkt.body)
 		conn.ackBytes(incomingMsgNo(pkt.msgNo), msg.BytesWritten())
 
@@ -259,8 +318,9 @@ func (conn *Connection) Send(msg *Message) (err error) {
 	if conn == nil {
 		return fmt.Errorf("cannot send on nil connection")
 	}
-	if conn.isClosed {
+	if conn.closed() {
 		err = fmt.Errorf("connection already closed")
+		return
 	}
 
 	conn.readWriterLock.Lock()
@@ -349,6 +409,13 @@ func (conn *Connection) ackBytes(msgno incomingMsgNo, unackedByteCount uint64) (
 	return
 }
 
+// closed reports whether Close has run
+func (conn *Connection) closed() bool {
+	conn.closedMutex.Lock()
+	defer conn.closedMutex.Unlock()
+	return conn.isClosed
+}
+
 // Close closes the current *Connection
 func (conn *Connection) Close() {
 	conn.closedMutex.Lock()
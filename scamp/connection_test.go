@@ -1,6 +1,14 @@
 package scamp
 
-import "testing"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestConnectionSend(t *testing.T) {
   // type Connection struct {
@@ -20,4 +28,216 @@ func TestConnectionSend(t *testing.T) {
   // conn = &Connection {
   //   conn 
   // }
-}
\ No newline at end of file
+}
+// serveTLS accepts connections for serv's TLS config and reports each handshake result
+func serveTLS(t *testing.T, serv *Service) (addr string, handshakes chan error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:       []tls.Certificate{serv.cert},
+		GetConfigForClient: serv.tlsConfigForClient,
+	})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	handshakes = make(chan error, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), handshakes
+}
+
+func TestDialPinnedConnection(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	addr, handshakes := serveTLS(t, serv)
+
+	fingerprint, err := pemFingerPrint(serv.pemCert)
+	if err != nil {
+		t.Fatalf("fingerprint: %s", err)
+	}
+
+	conn, err := DialPinnedConnection(addr, strings.ToLower(fingerprint))
+	if err != nil {
+		t.Fatalf("the announced certificate should be accepted: %s", err)
+	}
+	conn.Close()
+	<-handshakes
+
+	_, err = DialPinnedConnection(addr, "00:11:22:33")
+	if !errors.Is(err, ErrVerification) {
+		t.Errorf("expected a verification error for a different certificate, got %v", err)
+	}
+	<-handshakes
+
+	sp := &serviceProxy{ident: "announced-1234", connspec: "beepish+tls://" + addr, rawCert: serv.pemCert}
+	client, err := sp.GetClient()
+	if err != nil {
+		t.Fatalf("GetClient should dial the announced certificate: %s", err)
+	}
+	client.Close()
+
+	sp = &serviceProxy{ident: "announced-1234", connspec: "beepish+tls://" + addr}
+	_, err = sp.GetClient()
+	if !errors.Is(err, ErrVerification) {
+		t.Errorf("an instance without an announced certificate should not be dialed, got %v", err)
+	}
+}
+
+// runTestService runs a service with the fixture keypair on a loopback port, through
+// the same listen and accept path as a deployed service. setup configures the service
+// before it starts.
+func runTestService(t *testing.T, setup func(serv *Service)) *Service {
+	previous := defaultConfig
+	conf := NewConfig()
+	conf.Set("service.running_service_file_dir_path", t.TempDir())
+	defaultConfig = conf
+
+	fixture := newAnnouncedTestService(t)
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "announced", fixture.cert, fixture.pemCert)
+	if err != nil {
+		defaultConfig = previous
+		t.Fatalf("could not start service: %s", err)
+	}
+	serv.listenerIP = net.ParseIP("127.0.0.1")
+	setup(serv)
+	go serv.Run()
+	for !serv.running() {
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serv.Shutdown(ctx)
+		defaultConfig = previous
+	})
+	return serv
+}
+
+// replyWithCaller replies with the fingerprint of the caller's certificate
+func replyWithCaller(message *Message, client *Client) {
+	reply := NewResponseMessage()
+	reply.SetRequestID(message.RequestID)
+	reply.Write([]byte(client.Fingerprint()))
+	client.Send(reply)
+}
+
+func TestServiceClientAuth(t *testing.T) {
+	initSCAMPLogger()
+	serv := runTestService(t, func(serv *Service) {
+		serv.SetClientAuth(tls.RequireAnyClientCert)
+		serv.Register("Test.whoami", replyWithCaller, nil)
+	})
+	addr := serv.listener.Addr().String()
+
+	client, err := Dial(addr)
+	if err == nil {
+		_, replies := sendTestRequest(t, client, "Test.whoami")
+		select {
+		case reply := <-replies:
+			if reply != nil {
+				t.Errorf("a caller without a client certificate should be refused")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("a refused caller's connection should be closed")
+		}
+		client.Close()
+	}
+
+	keypair := serv.Certificate()
+	client, err = DialWithOptions(addr, DialOptions{Certificate: &keypair})
+	if err != nil {
+		t.Fatalf("dial with client certificate: %s", err)
+	}
+	defer client.Close()
+
+	_, replies := sendTestRequest(t, client, "Test.whoami")
+	var reply *Message
+	select {
+	case reply = <-replies:
+	case <-time.After(time.Second):
+		t.Fatalf("a caller with a client certificate should be accepted")
+	}
+	if reply == nil {
+		t.Fatalf("a caller with a client certificate should be accepted")
+	}
+
+	fingerprint, err := pemFingerPrint(serv.pemCert)
+	if err != nil {
+		t.Fatalf("fingerprint: %s", err)
+	}
+	if got := string(reply.Bytes()); got != fingerprint {
+		t.Errorf("handler saw caller %q, want %q", got, fingerprint)
+	}
+}
+
+func TestClientCloseClearsItsProxy(t *testing.T) {
+	initSCAMPLogger()
+	serv := runTestService(t, func(*Service) {})
+
+	// the proxy belongs to a requester's own cache, not DefaultCache
+	instance, err := parseAnnouncement(announcementOf(t, serv))
+	if err != nil {
+		t.Fatalf("parse announcement: %s", err)
+	}
+	cache := NewMemoryServiceCache()
+	cache.Store(instance)
+
+	client, err := instance.GetClient()
+	if err != nil {
+		t.Fatalf("GetClient: %s", err)
+	}
+	client.Close()
+
+	instance.clientM.Lock()
+	pooled := instance.client
+	instance.clientM.Unlock()
+	if pooled != nil {
+		t.Errorf("a closed client should be taken out of the proxy that pooled it")
+	}
+}
+
+func TestServiceCacheClientCertificate(t *testing.T) {
+	initSCAMPLogger()
+	serv := runTestService(t, func(serv *Service) {
+		serv.SetClientAuth(tls.RequireAnyClientCert)
+		serv.Register("Logging.info", replyWithCaller, nil)
+	})
+
+	instance, err := parseAnnouncement(announcementOf(t, serv))
+	if err != nil {
+		t.Fatalf("parse announcement: %s", err)
+	}
+	cache := NewMemoryServiceCache()
+	cache.Store(instance)
+	cache.SetClientCertificate(serv.Certificate())
+
+	client, err := instance.GetClient()
+	if err != nil {
+		t.Fatalf("GetClient should present the cache's client certificate: %s", err)
+	}
+
+	msg := NewRequestMessage()
+	msg.SetAction("Logging.info")
+	msg.SetEnvelope(EnvelopeJSON)
+	replies, err := client.Send(msg)
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	select {
+	case reply := <-replies:
+		if reply == nil || len(reply.Bytes()) == 0 {
+			t.Errorf("the service should have seen the cache's client certificate")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no reply from the service")
+	}
+}
@@ -1,24 +1,41 @@
 package scamp
 
 import (
-	"time"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"golang.org/x/net/ipv4"
 )
 
-// DiscoveryAnnouncer ... TODO: godoc
+// DiscoveryAnnouncer periodically multicasts the description of every tracked service
+// so discovery caches can find them
 type DiscoveryAnnouncer struct {
+	servicesM     sync.Mutex
 	services      []*Service
 	multicastConn *ipv4.PacketConn
 	multicastDest *net.UDPAddr
-	stopSig       (chan bool)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wake prompts the announce loop to look at newly tracked services
+	wake chan struct{}
+	// compress is set (to 1) by SetCompression
+	compress int32
 }
 
 // NewDiscoveryAnnouncer creates a DiscoveryAnnouncer
 func NewDiscoveryAnnouncer() (announcer *DiscoveryAnnouncer, err error) {
 	announcer = new(DiscoveryAnnouncer)
 	announcer.services = make([]*Service, 0, 0)
-	announcer.stopSig = make(chan bool)
+	announcer.ctx, announcer.cancel = context.WithCancel(context.Background())
+	announcer.wake = make(chan struct{}, 1)
 
 	config := DefaultConfig()
 	announcer.multicastDest = &net.UDPAddr{IP: config.DiscoveryMulticastIP(), Port: config.DiscoveryMulticastPort()}
@@ -31,46 +48,211 @@ func NewDiscoveryAnnouncer() (announcer *DiscoveryAnnouncer, err error) {
 	return
 }
 
-// Stop notifies stopSig channel to stop announcer
+// Stop ends AnnounceLoop. It does not block, even if the loop isn't running.
 func (announcer *DiscoveryAnnouncer) Stop() {
-	announcer.stopSig <- true
+	announcer.cancel()
+}
+
+// SetCompression turns zlib compression of large announcements on or off. It is off by
+// default because only scamp-go discovery listeners decode compressed announcements;
+// turn it on only when no other cache implementation listens for them.
+func (announcer *DiscoveryAnnouncer) SetCompression(enabled bool) {
+	var compress int32
+	if enabled {
+		compress = 1
+	}
+	atomic.StoreInt32(&announcer.compress, compress)
 }
 
 // Track indicates that announcer should track and announce service
 func (announcer *DiscoveryAnnouncer) Track(serv *Service) {
+	announcer.servicesM.Lock()
 	announcer.services = append(announcer.services, serv)
+	announcer.servicesM.Unlock()
+
+	serv.announcerM.Lock()
+	serv.announcer = announcer
+	serv.announcerM.Unlock()
+
+	select {
+	case announcer.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Untrack stops announcing serv and immediately sends a going-away announcement (a
+// weight of zero) so discovery caches drop the instance. Service.Shutdown calls it for
+// the announcer the service is tracked by.
+func (announcer *DiscoveryAnnouncer) Untrack(serv *Service) {
+	announcer.servicesM.Lock()
+	tracked := false
+	for i, entry := range announcer.services {
+		if entry == serv {
+			announcer.services = append(announcer.services[:i], announcer.services[i+1:]...)
+			tracked = true
+			break
+		}
+	}
+	announcer.servicesM.Unlock()
+
+	serv.announcerM.Lock()
+	if serv.announcer == announcer {
+		serv.announcer = nil
+	}
+	serv.announcerM.Unlock()
+
+	if !tracked {
+		return
+	}
+
+	err := announcer.announce(serv, true)
+	if err != nil {
+		Error.Printf("failed to announce departure of %s: `%s`", serv.name, err)
+	}
 }
 
-// AnnounceLoop runs service announceloop and runs announcer.doAnnounce() at time
-// interval configured in defaultAnnounceInterval
-// TODO: make defaultAnnounceInterval configurable in the service (rather than hardcoded in scamp)
+// AnnounceLoop announces every tracked service at its own AnnounceInterval until Stop
+// is called
 func (announcer *DiscoveryAnnouncer) AnnounceLoop() {
+	announcer.AnnounceLoopContext(announcer.ctx)
+}
+
+// AnnounceLoopContext is AnnounceLoop that also returns when ctx is done. Each service
+// is announced on its own schedule, jittered so that many instances started together
+// don't multicast in lockstep.
+func (announcer *DiscoveryAnnouncer) AnnounceLoopContext(ctx context.Context) {
 	// Trace.Printf("starting announcer loop")
+	next := make(map[*Service]time.Time)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
+		wait := announcer.announceDue(next, time.Now())
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
 		select {
-		case <-announcer.stopSig:
+		case <-ctx.Done():
 			return
-		default:
-			announcer.doAnnounce()
+		case <-announcer.ctx.Done():
+			return
+		case <-announcer.wake:
+		case <-timer.C:
 		}
-
-		time.Sleep(time.Duration(defaultAnnounceInterval) * time.Second)
 	}
 }
 
-func (announcer *DiscoveryAnnouncer) doAnnounce() (err error) {
-	for _, serv := range announcer.services {
-		serviceDesc, err := serv.MarshalText()
-		if err != nil {
-			Error.Printf("failed to marshal service as text: `%s`. skipping.", err)
+// announceDue announces the services whose time has come, schedules their next
+// announcement in next, and returns how long until the earliest one is due
+func (announcer *DiscoveryAnnouncer) announceDue(next map[*Service]time.Time, now time.Time) (wait time.Duration) {
+	services := announcer.tracked()
+	wait = time.Duration(defaultAnnounceInterval) * time.Second
+
+	tracked := make(map[*Service]bool, len(services))
+	for _, serv := range services {
+		tracked[serv] = true
+
+		due, ok := next[serv]
+		if !ok || !now.Before(due) {
+			err := announcer.announce(serv, serv.isDraining())
+			if err != nil {
+				Error.Printf("failed to announce %s: `%s`. skipping.", serv.name, err)
+			}
+			due = now.Add(jitter(serv.AnnounceInterval()))
+			next[serv] = due
 		}
 
-		_, err = announcer.multicastConn.WriteTo(serviceDesc, nil, announcer.multicastDest)
-		if err != nil {
-			return err
+		if untilDue := due.Sub(now); untilDue < wait {
+			wait = untilDue
 		}
 	}
 
+	for serv := range next {
+		if !tracked[serv] {
+			delete(next, serv)
+		}
+	}
+	return
+}
+
+// jitter spreads interval by up to 10% either way
+func jitter(interval time.Duration) time.Duration {
+	spread := float64(interval) * 0.1
+	return interval + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+func (announcer *DiscoveryAnnouncer) tracked() []*Service {
+	announcer.servicesM.Lock()
+	defer announcer.servicesM.Unlock()
+
+	services := make([]*Service, len(announcer.services))
+	copy(services, announcer.services)
+	return services
+}
+
+// announce multicasts one service description
+func (announcer *DiscoveryAnnouncer) announce(serv *Service, goingAway bool) (err error) {
+	serviceDesc, err := serv.marshalAnnouncement(goingAway)
+	if err != nil {
+		return
+	}
+
+	packet, err := encodeAnnouncement(serviceDesc, atomic.LoadInt32(&announcer.compress) == 1)
+	if err != nil {
+		return
+	}
+
+	if announcer.multicastConn == nil {
+		return
+	}
+	_, err = announcer.multicastConn.WriteTo(packet, nil, announcer.multicastDest)
+	return
+}
+
+// announceCompressThreshold is the size above which announcements are zlib compressed,
+// to keep them inside a single datagram on a typical 1500 byte MTU
+const announceCompressThreshold = 1400
+
+// encodeAnnouncement compresses large announcements when compress is set. Small ones are
+// always sent as they are, which every discovery cache understands.
+func encodeAnnouncement(serviceDesc []byte, compress bool) (packet []byte, err error) {
+	if !compress || len(serviceDesc) <= announceCompressThreshold {
+		return serviceDesc, nil
+	}
+
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	_, err = writer.Write(serviceDesc)
+	if err != nil {
+		return
+	}
+	err = writer.Close()
+	if err != nil {
+		return
+	}
+
+	packet = buf.Bytes()
 	return
 }
+
+// decodeAnnouncement undoes encodeAnnouncement. Plain announcements start with the `[`
+// of their class records, so a zlib header is unambiguous.
+func decodeAnnouncement(packet []byte) (serviceDesc []byte, err error) {
+	if len(packet) < 2 || packet[0] != 0x78 || (uint16(packet[0])<<8|uint16(packet[1]))%31 != 0 {
+		return packet, nil
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(packet))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,217 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newAnnouncedTestService(t *testing.T) *Service {
+	cert, err := tls.LoadX509KeyPair("../fixtures/sample.crt", "../fixtures/sample.key")
+	if err != nil {
+		t.Fatalf("could not load fixture keypair: `%s`", err)
+	}
+	pemCert, err := ioutil.ReadFile("../fixtures/sample.crt")
+	if err != nil {
+		t.Fatalf("could not load fixture certificate")
+	}
+
+	serv := &Service{
+		humanName:    "announced",
+		name:         "announced-1234",
+		sector:       "main",
+		listenerIP:   net.ParseIP("127.0.0.1"),
+		listenerPort: 30100,
+		actions:      make(map[string]*ServiceAction),
+		pemCert:      bytes.TrimSpace(pemCert),
+		cert:         cert,
+	}
+	serv.Register("Logging.info", func(_ *Message, _ *Client) {}, nil)
+	return serv
+}
+
+func scanAnnouncement(t *testing.T, announcement []byte) *ServiceCache {
+	cache := &ServiceCache{
+		identIndex:  make(map[string]*serviceProxy),
+		actionIndex: make(map[string][]*serviceProxy),
+	}
+
+	var buf bytes.Buffer
+	buf.Write(sep)
+	buf.Write(newline)
+	buf.Write(announcement)
+
+	err := cache.DoScan(bufio.NewScanner(&buf))
+	if err != nil {
+		t.Fatalf("could not scan announcement: %s", err)
+	}
+	return cache
+}
+
+func TestGoingAwayAnnouncementDropsInstance(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+
+	announcement, err := serv.marshalAnnouncement(false)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	if scanAnnouncement(t, announcement).Size() != 1 {
+		t.Errorf("expected the instance to be cached")
+	}
+
+	announcement, err = serv.marshalAnnouncement(true)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	if scanAnnouncement(t, announcement).Size() != 0 {
+		t.Errorf("expected a going-away announcement to be dropped")
+	}
+}
+
+func TestAnnouncerUntrack(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	announcer := &DiscoveryAnnouncer{}
+
+	announcer.Track(serv)
+	if serv.announcer != announcer || len(announcer.services) != 1 {
+		t.Fatalf("service was not tracked")
+	}
+
+	announcer.Untrack(serv)
+	if serv.announcer != nil || len(announcer.services) != 0 {
+		t.Errorf("service was not untracked")
+	}
+}
+
+func TestAnnounceDueHonoursServiceIntervals(t *testing.T) {
+	initSCAMPLogger()
+	fast := newAnnouncedTestService(t)
+	fast.SetAnnounceInterval(time.Second)
+	slow := newAnnouncedTestService(t)
+	slow.SetAnnounceInterval(time.Minute)
+
+	announcer := &DiscoveryAnnouncer{}
+	announcer.Track(fast)
+	announcer.Track(slow)
+
+	now := time.Now()
+	next := make(map[*Service]time.Time)
+	wait := announcer.announceDue(next, now)
+	if wait < 900*time.Millisecond || wait > 1100*time.Millisecond {
+		t.Errorf("expected to wake for the fast service in about 1s, got %s", wait)
+	}
+	if until := next[slow].Sub(now); until < 54*time.Second || until > 66*time.Second {
+		t.Errorf("slow service scheduled %s out", until)
+	}
+
+	slowDue := next[slow]
+	announcer.announceDue(next, now.Add(2*time.Second))
+	if !next[slow].Equal(slowDue) {
+		t.Errorf("slow service should not have been announced again")
+	}
+
+	announcer.Untrack(fast)
+	announcer.announceDue(next, now.Add(3*time.Second))
+	if _, ok := next[fast]; ok {
+		t.Errorf("untracked service should be forgotten")
+	}
+}
+
+func TestServiceWeight(t *testing.T) {
+	serv := newAnnouncedTestService(t)
+	if serv.Weight() != 1 {
+		t.Errorf("expected default weight 1, got %d", serv.Weight())
+	}
+
+	serv.SetWeight(0)
+	if sp := serviceAsServiceProxy(serv); sp.weight != 0 {
+		t.Errorf("expected announced weight 0, got %d", sp.weight)
+	}
+	// zero drains the instance rather than making it a last resort
+	if cache := scanAnnouncement(t, announcementOf(t, serv)); cache.Size() != 0 {
+		t.Errorf("a zero-weight instance should not be cached")
+	}
+	if serv.SetWeight(-1) == nil {
+		t.Errorf("negative weights should be rejected")
+	}
+}
+
+func TestAnnouncementGroupsActionsByClass(t *testing.T) {
+	serv := newAnnouncedTestService(t)
+	serv.Register("Logging.warn", func(_ *Message, _ *Client) {}, nil)
+	serv.Register("Auth.login", func(_ *Message, _ *Client) {}, nil)
+
+	sp := serviceAsServiceProxy(serv)
+	if len(sp.classes) != 2 || sp.classes[0].className != "Auth" || sp.classes[1].className != "Logging" {
+		t.Fatalf("expected classes Auth and Logging, got %+v", sp.classes)
+	}
+
+	logging := sp.classes[1].actions
+	if len(logging) != 2 || logging[0].actionName != "info" || logging[1].actionName != "warn" {
+		t.Errorf("expected Logging to hold info and warn, got %+v", logging)
+	}
+}
+
+func TestAnnouncementCompression(t *testing.T) {
+	small := []byte(`[3,"ident"]`)
+	packet, err := encodeAnnouncement(small, true)
+	if err != nil || !bytes.Equal(packet, small) {
+		t.Errorf("small announcements should be sent as is")
+	}
+
+	// other discovery caches can't read compressed announcements, so it is opt-in
+	large := bytes.Repeat([]byte(`["Logging",["info","",1]],`), 200)
+	packet, err = encodeAnnouncement(large, false)
+	if err != nil || !bytes.Equal(packet, large) {
+		t.Errorf("announcements should only be compressed when asked to")
+	}
+
+	packet, err = encodeAnnouncement(large, true)
+	if err != nil || len(packet) >= announceCompressThreshold {
+		t.Fatalf("expected a compressed packet under the threshold, got %d bytes (%v)", len(packet), err)
+	}
+
+	for _, sent := range [][]byte{small, large} {
+		packet, _ = encodeAnnouncement(sent, true)
+		decoded, err := decodeAnnouncement(packet)
+		if err != nil || !bytes.Equal(decoded, sent) {
+			t.Errorf("announcement did not survive a round trip (%v)", err)
+		}
+	}
+}
+
+func TestAnnounceActionsInSeveralSectors(t *testing.T) {
+	serv := newAnnouncedTestService(t)
+	err := serv.Register("Report.rebuild", func(_ *Message, _ *Client) {}, &ActionOptions{Sector: "background"})
+	if err != nil {
+		t.Fatalf("register failed: %s", err)
+	}
+	if serv.Register("Report.rebuild", func(_ *Message, _ *Client) {}, &ActionOptions{Sector: "main"}) == nil {
+		t.Errorf("the same action and version can't be registered in two sectors")
+	}
+
+	classRecords, err := serviceAsServiceProxy(serv).MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	sp, err := newServiceProxy(classRecords, nil, nil)
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+
+	if _, ok := sp.findAction("background", "Report.rebuild", 1); !ok {
+		t.Errorf("background action missing from `%s`", classRecords)
+	}
+	if _, ok := sp.findAction("main", "Logging.info", 1); !ok {
+		t.Errorf("main action missing from `%s`", classRecords)
+	}
+	if !bytes.Contains(classRecords, []byte(`"acsec":[[1,"background"]]`)) {
+		t.Errorf("expected the sector in acsec: `%s`", classRecords)
+	}
+}
@@ -0,0 +1,288 @@
+package scamp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action flags with a meaning to scamp-go. Flags travel in the crud tags field of v3
+// class records and in acflag of the v4 extension.
+const (
+	// FlagNoAuth marks actions that don't need a ticket
+	FlagNoAuth = "noauth"
+	// FlagInternal marks actions that are not meant to be exposed outside the SOA
+	FlagInternal = "internal"
+	// FlagIdempotent marks actions that are safe to run twice for one request, so
+	// requesters may hedge them. Actions tagged read are idempotent too.
+	FlagIdempotent = "idempotent"
+)
+
+// timeoutFlag formats a timeout hint flag, e.g. t600 for ten minutes
+func timeoutFlag(timeout time.Duration) string {
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	return fmt.Sprintf("t%d", seconds)
+}
+
+// flags splits the action's crud tags field into its flags
+func (ad actionDescription) flags() (flags []string) {
+	for _, flag := range strings.Split(ad.crudTags, ",") {
+		flag = strings.TrimSpace(flag)
+		if len(flag) > 0 {
+			flags = append(flags, flag)
+		}
+	}
+	return
+}
+
+// HasFlag reports whether the action was announced with flag
+func (ad actionDescription) HasFlag(flag string) bool {
+	for _, candidate := range ad.flags() {
+		if candidate == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Idempotent reports whether the action was announced as safe to run twice, with the
+// read crud tag or FlagIdempotent
+func (ad actionDescription) Idempotent() bool {
+	return ad.HasFlag(CrudRead) || ad.HasFlag(FlagIdempotent)
+}
+
+// Timeout returns the timeout announced with a tNNN flag, or zero
+func (ad actionDescription) Timeout() time.Duration {
+	for _, flag := range ad.flags() {
+		if len(flag) < 2 || flag[0] != 't' {
+			continue
+		}
+		seconds, err := strconv.Atoi(flag[1:])
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// inV3 reports whether the action can be described by a v3 class record of sp, which
+// has no room for a sector or envelopes of its own
+func (sp *serviceProxy) inV3(action actionDescription) bool {
+	if len(action.sector) > 0 && action.sector != sp.sector {
+		return false
+	}
+	if action.envelopes == nil {
+		return true
+	}
+	return strings.Join(action.envelopes, ",") == strings.Join(sp.protocols, ",")
+}
+
+// actionSector is the sector an action is offered in
+func (sp *serviceProxy) actionSector(action actionDescription) string {
+	if len(action.sector) > 0 {
+		return action.sector
+	}
+	return sp.sector
+}
+
+// actionEnvelopes are the envelopes an action accepts
+func (sp *serviceProxy) actionEnvelopes(action actionDescription) []string {
+	if action.envelopes != nil {
+		return action.envelopes
+	}
+	return sp.protocols
+}
+
+// rleWriter builds a run-length encoded extension column: [[count, value], ...]
+type rleWriter struct {
+	runs []interface{}
+	last interface{}
+	n    int
+}
+
+func (w *rleWriter) add(value interface{}) {
+	if w.n > 0 && w.last == value {
+		w.n++
+		return
+	}
+	w.flush()
+	w.last = value
+	w.n = 1
+}
+
+func (w *rleWriter) flush() {
+	if w.n > 0 {
+		w.runs = append(w.runs, []interface{}{w.n, w.last})
+	}
+	w.n = 0
+}
+
+func (w *rleWriter) column() []interface{} {
+	w.flush()
+	if w.runs == nil {
+		return []interface{}{}
+	}
+	return w.runs
+}
+
+// buildExtension describes the actions that don't fit in v3 class records. It returns
+// nil when every action fits.
+func (sp *serviceProxy) buildExtension() *ServiceProxyDiscoveryExtension {
+	var namespaces, versions, envelopes, flags, sectors rleWriter
+	names := make([]interface{}, 0)
+
+	for _, class := range sp.classes {
+		for _, action := range class.actions {
+			if sp.inV3(action) {
+				continue
+			}
+
+			namespaces.add(class.className)
+			names = append(names, action.actionName)
+			versions.add(action.version)
+			envelopes.add(strings.Join(sp.actionEnvelopes(action), ","))
+			flags.add(action.crudTags)
+			sectors.add(sp.actionSector(action))
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	return &ServiceProxyDiscoveryExtension{
+		Vmin:   0,
+		Vmaj:   4,
+		AcSec:  sectors.column(),
+		AcName: names,
+		AcVer:  versions.column(),
+		AcEnv:  envelopes.column(),
+		AcFlag: flags.column(),
+		AcNs:   namespaces.column(),
+	}
+}
+
+// expandRLE undoes rleWriter for a column of n entries. Entries that aren't
+// [count, value] pairs count once.
+func expandRLE(column []interface{}) (values []interface{}, err error) {
+	for _, entry := range column {
+		pair, ok := entry.([]interface{})
+		if !ok {
+			values = append(values, entry)
+			continue
+		}
+		if len(pair) != 2 {
+			err = fmt.Errorf("bad run-length entry `%v`", entry)
+			return
+		}
+
+		count, ok := pair[0].(float64)
+		if !ok || count < 0 {
+			err = fmt.Errorf("bad run-length count `%v`", pair[0])
+			return
+		}
+		for i := 0; i < int(count); i++ {
+			values = append(values, pair[1])
+		}
+	}
+	return
+}
+
+// extensionString reads entry i of an expanded column as a string, or fallback
+func extensionString(values []interface{}, i int, fallback string) string {
+	if i >= len(values) {
+		return fallback
+	}
+	switch value := values[i].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fallback
+}
+
+// applyExtension adds the actions described by a v4 extension to sp.classes
+func (sp *serviceProxy) applyExtension() (err error) {
+	extension := sp.extension
+	if extension == nil || extension.Vmaj != 4 {
+		return
+	}
+
+	columns := make([][]interface{}, 5)
+	for i, column := range [][]interface{}{extension.AcNs, extension.AcVer, extension.AcEnv, extension.AcFlag, extension.AcSec} {
+		columns[i], err = expandRLE(column)
+		if err != nil {
+			return
+		}
+	}
+	namespaces, versions, envelopes, flags, sectors := columns[0], columns[1], columns[2], columns[3], columns[4]
+
+	classIndex := make(map[string]int)
+	for i, class := range sp.classes {
+		classIndex[class.className] = i
+	}
+
+	for i, rawName := range extension.AcName {
+		name, ok := rawName.(string)
+		if !ok {
+			err = fmt.Errorf("bad action name `%v` in discovery extension", rawName)
+			return
+		}
+
+		namespace := extensionString(namespaces, i, "")
+		if len(namespace) == 0 {
+			err = fmt.Errorf("no namespace for action `%s` in discovery extension", name)
+			return
+		}
+
+		action := actionDescription{
+			actionName: name,
+			crudTags:   extensionString(flags, i, ""),
+			version:    1,
+			sector:     extensionString(sectors, i, ""),
+		}
+
+		version, convErr := strconv.Atoi(extensionString(versions, i, "1"))
+		if convErr == nil {
+			action.version = version
+		}
+
+		if envelope := extensionString(envelopes, i, ""); len(envelope) > 0 {
+			action.envelopes = strings.Split(envelope, ",")
+		}
+
+		index, ok := classIndex[namespace]
+		if !ok {
+			index = len(sp.classes)
+			classIndex[namespace] = index
+			sp.classes = append(sp.classes, serviceProxyClass{className: namespace})
+		}
+		sp.classes[index].actions = append(sp.classes[index].actions, action)
+	}
+
+	return
+}
+
+// findAction returns the announced description of sector:name~version, if sp offers it
+func (sp *serviceProxy) findAction(sector, name string, version int) (action actionDescription, ok bool) {
+	dot := strings.LastIndex(name, ".")
+	if dot == -1 {
+		return
+	}
+	className, actionName := name[:dot], name[dot+1:]
+
+	for _, class := range sp.classes {
+		if !strings.EqualFold(class.className, className) {
+			continue
+		}
+		for _, candidate := range class.actions {
+			if strings.EqualFold(candidate.actionName, actionName) && candidate.version == version &&
+				strings.EqualFold(sp.actionSector(candidate), sector) {
+				return candidate, true
+			}
+		}
+	}
+	return
+}
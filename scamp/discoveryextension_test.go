@@ -0,0 +1,104 @@
+package scamp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExtensionRoundTrip(t *testing.T) {
+	sp := &serviceProxy{
+		version:   3,
+		ident:     "worker-1234",
+		sector:    "main",
+		weight:    1,
+		connspec:  "beepish+tls://127.0.0.1:30100",
+		protocols: []string{"json"},
+		classes: []serviceProxyClass{
+			{className: "Report", actions: []actionDescription{
+				{actionName: "fetch", crudTags: "read", version: 1},
+				{actionName: "fetch", crudTags: "read,t600", version: 2, envelopes: []string{"json", "jsonstore"}},
+				{actionName: "rebuild", crudTags: "noauth", version: 1, sector: "background"},
+			}},
+		},
+	}
+
+	classRecords, err := sp.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+
+	parsed, err := newServiceProxy(classRecords, nil, nil)
+	if err != nil {
+		t.Fatalf("parse failed: %s (%s)", err, classRecords)
+	}
+	if parsed.extension == nil || parsed.extension.Vmaj != 4 {
+		t.Fatalf("expected a v4 extension in `%s`", classRecords)
+	}
+
+	fetch, ok := parsed.findAction("main", "Report.fetch", 2)
+	if !ok || fetch.Timeout() != 600*time.Second || len(parsed.actionEnvelopes(fetch)) != 2 {
+		t.Errorf("Report.fetch~2 did not survive: %+v", fetch)
+	}
+	if _, ok = parsed.findAction("main", "Report.fetch", 1); !ok {
+		t.Errorf("Report.fetch~1 missing")
+	}
+	rebuild, ok := parsed.findAction("background", "Report.rebuild", 1)
+	if !ok || !rebuild.HasFlag(FlagNoAuth) {
+		t.Errorf("background:Report.rebuild did not survive: %+v", rebuild)
+	}
+	if _, ok = parsed.findAction("main", "Report.rebuild", 1); ok {
+		t.Errorf("Report.rebuild should only be offered in background")
+	}
+}
+
+func TestParseAnnouncedExtension(t *testing.T) {
+	classRecords := []byte(`[3,"amazon-1234","main",1,5000,"beepish+tls://10.0.0.1:30100",["json",{"vmin":0,"vmaj":4,"acsec":[[7,"background"]],"acname":["_evaluate","_execute","_evaluate","_execute","_munge","_evaluate","_execute"],"acver":[[7,1]],"acenv":[[7,"json,jsonstore,extdirect"]],"acflag":[[7,""]],"acns":[[2,"Channel.Amazon.FeedInterchange"],[3,"Channel.Amazon.InvPush"],[2,"Channel.Amazon.OrderImport"]]}],[],1440001142628.000000]`)
+
+	sp, err := newServiceProxy(classRecords, nil, nil)
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+
+	cache := &ServiceCache{
+		identIndex:  make(map[string]*serviceProxy),
+		actionIndex: make(map[string][]*serviceProxy),
+	}
+	cache.Store(sp)
+
+	for _, action := range []string{"Channel.Amazon.FeedInterchange._execute", "Channel.Amazon.InvPush._munge", "Channel.Amazon.OrderImport._evaluate"} {
+		_, err = cache.SearchByAction("background", action, 1, "extdirect")
+		if err != nil {
+			t.Errorf("%s: %s", action, err)
+		}
+	}
+	if _, err = cache.SearchByAction("main", "Channel.Amazon.InvPush._munge", 1, "json"); err == nil {
+		t.Errorf("extension actions should not be indexed in the main sector")
+	}
+}
+
+func TestRequesterUsesAnnouncedTimeout(t *testing.T) {
+	cache := &ServiceCache{
+		identIndex:  make(map[string]*serviceProxy),
+		actionIndex: make(map[string][]*serviceProxy),
+	}
+	cache.Store(&serviceProxy{
+		ident:     "slow-1",
+		sector:    "main",
+		weight:    1,
+		protocols: []string{"json"},
+		classes: []serviceProxyClass{
+			{className: "Report", actions: []actionDescription{{actionName: "build", crudTags: "t600", version: 1}}},
+		},
+	})
+	requester := NewScampRequesterWithCache(NewCacheRefresher(cache, RefresherOptions{}))
+
+	if timeout := requester.timeoutFor("main", "Report.build", 1, EnvelopeJSON, 0); timeout != 600*time.Second {
+		t.Errorf("expected the announced timeout, got %s", timeout)
+	}
+	if timeout := requester.timeoutFor("main", "Report.build", 1, EnvelopeJSON, time.Second); timeout != time.Second {
+		t.Errorf("the caller's timeout should win, got %s", timeout)
+	}
+	if timeout := requester.timeoutFor("main", "Report.other", 1, EnvelopeJSON, 0); timeout != DefaultRequestTimeout {
+		t.Errorf("expected the default timeout, got %s", timeout)
+	}
+}
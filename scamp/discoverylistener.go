@@ -0,0 +1,178 @@
+package scamp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// listenerExpiryIntervals is how many of its own announce intervals an instance may
+// go unheard before the listener drops it. Announcements are jittered and multicast
+// loses packets, so a single missed announcement must not remove an instance.
+const listenerExpiryIntervals = 3
+
+// listenerSweepInterval is how often the listener checks for expired instances
+const listenerSweepInterval = time.Second
+
+// DiscoveryListener receives the multicast announcements sent by DiscoveryAnnouncer
+// and keeps a ServiceCache up to date with them, without a cache file.
+type DiscoveryListener struct {
+	cache *ServiceCache
+	conn  *net.UDPConn
+
+	// lastHeard is when each ident last announced itself, by the local clock so that
+	// skew between hosts doesn't expire instances early
+	lastHeardM sync.Mutex
+	lastHeard  map[string]time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewDiscoveryListener joins the configured discovery group
+// (discovery.multicast_address and discovery.port) and fills cache from it
+func NewDiscoveryListener(cache *ServiceCache) (listener *DiscoveryListener, err error) {
+	config := DefaultConfig()
+	return NewDiscoveryListenerAt(cache, &net.UDPAddr{IP: config.DiscoveryMulticastIP(), Port: config.DiscoveryMulticastPort()})
+}
+
+// NewDiscoveryListenerAt listens for announcements on addr. A multicast addr is joined
+// on the system default interface; any other addr is listened on directly, which is
+// handy for tests over loopback.
+func NewDiscoveryListenerAt(cache *ServiceCache, addr *net.UDPAddr) (listener *DiscoveryListener, err error) {
+	listener = new(DiscoveryListener)
+	listener.cache = cache
+	listener.lastHeard = make(map[string]time.Time)
+	listener.ctx, listener.cancel = context.WithCancel(context.Background())
+
+	if addr.IP.IsMulticast() {
+		listener.conn, err = net.ListenMulticastUDP("udp4", nil, addr)
+	} else {
+		listener.conn, err = net.ListenUDP("udp4", addr)
+	}
+	if err != nil {
+		err = fmt.Errorf("could not listen for discovery on `%s`: %s", addr, err)
+		return
+	}
+
+	return
+}
+
+// Addr is the address the listener receives announcements on
+func (listener *DiscoveryListener) Addr() net.Addr {
+	return listener.conn.LocalAddr()
+}
+
+// Stop ends Listen and closes the socket
+func (listener *DiscoveryListener) Stop() {
+	listener.cancel()
+	listener.conn.Close()
+}
+
+// Listen stores every verified announcement in the cache and drops instances that stop
+// announcing, until Stop is called
+func (listener *DiscoveryListener) Listen() {
+	listener.ListenContext(listener.ctx)
+}
+
+// ListenContext is Listen that also returns when ctx is done
+func (listener *DiscoveryListener) ListenContext(ctx context.Context) {
+	buf := make([]byte, 64*1024)
+	nextSweep := time.Now().Add(listenerSweepInterval)
+
+	for ctx.Err() == nil && listener.ctx.Err() == nil {
+		listener.conn.SetReadDeadline(nextSweep)
+		n, _, err := listener.conn.ReadFromUDP(buf)
+		if err == nil {
+			// the stored instance keeps slices of the packet, so it can't share buf
+			err = listener.handlePacket(append([]byte(nil), buf[:n]...))
+			if err != nil {
+				Error.Printf("discarding announcement: %s", err)
+			}
+		} else if errors.Is(err, net.ErrClosed) {
+			return
+		} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			Error.Printf("discovery read failed: %s", err)
+		}
+
+		if now := time.Now(); !now.Before(nextSweep) {
+			listener.expire(now)
+			nextSweep = now.Add(listenerSweepInterval)
+		}
+	}
+}
+
+func (listener *DiscoveryListener) handlePacket(packet []byte) (err error) {
+	instance, err := parseAnnouncement(packet)
+	if err != nil {
+		return
+	}
+
+	// a repeat of the stored announcement was validated when it was first heard; it is
+	// still stored, to carry its fresh timestamp
+	instance, repeated := listener.cache.reuse(instance)
+	if listener.cache.verifyRecords && !repeated {
+		err = instance.Validate()
+		if err != nil {
+			return fmt.Errorf("%s: %s", instance.ident, err)
+		}
+	}
+
+	listener.lastHeardM.Lock()
+	if instance.weight <= 0 {
+		delete(listener.lastHeard, instance.ident)
+	} else {
+		listener.lastHeard[instance.ident] = time.Now()
+	}
+	listener.lastHeardM.Unlock()
+
+	listener.cache.Store(instance)
+	return
+}
+
+// expire removes instances that have not been heard from for listenerExpiryIntervals
+// of their announce interval
+func (listener *DiscoveryListener) expire(now time.Time) {
+	listener.lastHeardM.Lock()
+	var expired []string
+	for ident, heard := range listener.lastHeard {
+		instance := listener.cache.Retrieve(ident)
+		if instance == nil {
+			delete(listener.lastHeard, ident)
+			continue
+		}
+
+		interval := instance.announcePeriod()
+		if now.Sub(heard) > listenerExpiryIntervals*interval {
+			delete(listener.lastHeard, ident)
+			expired = append(expired, ident)
+		}
+	}
+	listener.lastHeardM.Unlock()
+
+	if len(expired) > 0 {
+		listener.cache.Remove(expired...)
+	}
+}
+
+// parseAnnouncement reads one announcement packet as sent by DiscoveryAnnouncer: the
+// class records, certificate and signature separated by blank lines, possibly
+// compressed
+func parseAnnouncement(packet []byte) (instance *serviceProxy, err error) {
+	serviceDesc, err := decodeAnnouncement(packet)
+	if err != nil {
+		return
+	}
+
+	parts := bytes.SplitN(bytes.TrimSpace(serviceDesc), []byte("\n\n"), 3)
+	if len(parts) != 3 {
+		err = errors.New("announcement is missing its certificate or signature")
+		return
+	}
+
+	return newServiceProxy(bytes.TrimSpace(parts[0]), bytes.TrimSpace(parts[1]), bytes.TrimSpace(parts[2]))
+}
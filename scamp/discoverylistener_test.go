@@ -0,0 +1,154 @@
+package scamp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newLoopbackListener(t *testing.T) (*DiscoveryListener, chan CacheEvent, *net.UDPConn) {
+	cache := NewMemoryServiceCache()
+	events := make(chan CacheEvent, 8)
+	cache.Subscribe(func(event CacheEvent) {
+		events <- event
+	})
+
+	listener, err := NewDiscoveryListenerAt(cache, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	go listener.Listen()
+	t.Cleanup(listener.Stop)
+
+	sender, err := net.DialUDP("udp4", nil, listener.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { sender.Close() })
+
+	return listener, events, sender
+}
+
+func nextCacheEvent(t *testing.T, events chan CacheEvent) CacheEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no cache event")
+	}
+	return CacheEvent{}
+}
+
+func TestDiscoveryListenerStoresAnnouncements(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	listener, events, sender := newLoopbackListener(t)
+
+	// a forged announcement is dropped, the genuine one after it is stored
+	forged := bytes.Replace(announcementOf(t, serv), []byte("Logging"), []byte("Forging"), 1)
+	sender.Write(forged)
+
+	packet, err := encodeAnnouncement(announcementOf(t, serv), true)
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	sender.Write(packet)
+
+	event := nextCacheEvent(t, events)
+	if event.Type != CacheAdded || event.Ident != "announced-1234" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	instances, err := listener.cache.SearchByAction("main", "Logging.info", 1, "json")
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("expected the announced action, got %v (%v)", instances, err)
+	}
+
+	goingAway, err := serv.marshalAnnouncement(true)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	sender.Write(goingAway)
+
+	event = nextCacheEvent(t, events)
+	if event.Type != CacheRemoved || listener.cache.Size() != 0 {
+		t.Fatalf("expected the going-away announcement to remove the instance: %+v", event)
+	}
+}
+
+func TestDiscoveryListenerExpiresSilentInstances(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	listener, events, sender := newLoopbackListener(t)
+
+	sender.Write(announcementOf(t, serv))
+	nextCacheEvent(t, events)
+
+	listener.expire(time.Now().Add(2 * serv.AnnounceInterval()))
+	if listener.cache.Size() != 1 {
+		t.Fatalf("an instance should survive a couple of missed announcements")
+	}
+
+	listener.expire(time.Now().Add(4 * serv.AnnounceInterval()))
+	event := nextCacheEvent(t, events)
+	if event.Type != CacheRemoved || listener.cache.Size() != 0 {
+		t.Fatalf("expected the silent instance to expire: %+v", event)
+	}
+}
+
+func TestDiscoveryListenerSkipsRepeatedAnnouncements(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	other := newAnnouncedTestService(t)
+	other.name = "other-1234"
+	listener, events, sender := newLoopbackListener(t)
+
+	announcement := announcementOf(t, serv)
+	sender.Write(announcement)
+	nextCacheEvent(t, events)
+	stored := listener.cache.Retrieve("announced-1234")
+
+	// the repeat is handled before the other instance's announcement
+	sender.Write(announcement)
+	sender.Write(announcementOf(t, other))
+	if event := nextCacheEvent(t, events); event.Ident != "other-1234" {
+		t.Fatalf("a repeated announcement should not change the cache: %+v", event)
+	}
+	if listener.cache.Retrieve("announced-1234") != stored {
+		t.Errorf("a repeated announcement should be neither validated nor stored again")
+	}
+}
+
+func TestDiscoveryListenerReusesValidationAcrossTimestamps(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	other := newAnnouncedTestService(t)
+	other.name = "other-1234"
+	listener, events, sender := newLoopbackListener(t)
+
+	sender.Write(announcementOf(t, serv))
+	nextCacheEvent(t, events)
+	stored := listener.cache.Retrieve("announced-1234")
+
+	// the next announcement differs only in its timestamp
+	time.Sleep(2 * time.Millisecond)
+	restamped := announcementOf(t, serv)
+	sender.Write(restamped)
+	sender.Write(announcementOf(t, other))
+	if event := nextCacheEvent(t, events); event.Ident != "other-1234" {
+		t.Fatalf("a new timestamp alone should not change the cache: %+v", event)
+	}
+
+	instance := listener.cache.Retrieve("announced-1234")
+	parsed, err := parseAnnouncement(restamped)
+	if err != nil {
+		t.Fatalf("parse announcement: %s", err)
+	}
+	if !instance.announcedAt().Equal(parsed.announcedAt()) {
+		t.Errorf("the stored instance should carry the latest timestamp")
+	}
+	// validating would have rebuilt the actions; reusing the validation keeps them
+	if len(instance.classes) == 0 || &instance.classes[0] != &stored.classes[0] {
+		t.Errorf("an announcement differing only in timestamp should not be validated again")
+	}
+}
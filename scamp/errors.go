@@ -0,0 +1,189 @@
+package scamp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Error codes scamp-go puts in the ErrorCode header of error replies
+const (
+	// ErrorCodeGeneral is used for handler errors that don't carry their own code
+	ErrorCodeGeneral = "general"
+	// ErrorCodeTransport marks replies that were cut short by the connection (TXERR)
+	ErrorCodeTransport = "transport"
+	// ErrorCodeVerification is used when a ticket or privilege check fails
+	ErrorCodeVerification = "verification"
+	// ErrorCodeNotFound is used when a service has no handler for the requested action
+	ErrorCodeNotFound = "not_found"
+	// ErrorCodeUnknownVersion is used when a service has the requested action, but not
+	// the requested version of it
+	ErrorCodeUnknownVersion = "unknown_version"
+	// ErrorCodeBadRequest is used when a request body can't be decoded
+	ErrorCodeBadRequest = "bad_request"
+	// ErrorCodeInternal is used when a handler panics
+	ErrorCodeInternal = "internal"
+	// ErrorCodeUnavailable is used when a shutting down service turns a request away
+	// without handling it, so it is safe to send elsewhere
+	ErrorCodeUnavailable = "unavailable"
+)
+
+// Sentinels for use with errors.Is. Every error type below matches one of them.
+var (
+	ErrTransport    = errors.New("scamp: transport failure")
+	ErrTimeout      = errors.New("scamp: request timed out")
+	ErrNoInstances  = errors.New("scamp: no instances found")
+	ErrVerification = errors.New("scamp: verification failed")
+	ErrRemote       = errors.New("scamp: remote error")
+)
+
+// TransportError means a request could not be delivered, or the connection failed
+// before its reply arrived
+type TransportError struct {
+	// Ident of the instance involved, if known
+	Ident string
+	// Sent is true when the message went out before the failure
+	Sent bool
+	Err  error
+}
+
+func (e *TransportError) Error() string {
+	if len(e.Ident) > 0 {
+		return fmt.Sprintf("transport failure (%s): %s", e.Ident, e.Err)
+	}
+	return fmt.Sprintf("transport failure: %s", e.Err)
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+func (e *TransportError) Is(target error) bool { return target == ErrTransport }
+
+// TimeoutError means no reply arrived before the request's deadline.
+// It unwraps to context.DeadlineExceeded.
+type TimeoutError struct {
+	Action string
+	Err    error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("request timed out: %s", e.Action)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+func (e *TimeoutError) Is(target error) bool { return target == ErrTimeout }
+
+// NoInstancesError means discovery knows no instance offering the action
+type NoInstancesError struct {
+	Sector   string
+	Action   string
+	Version  int
+	Envelope string
+}
+
+func (e *NoInstancesError) Error() string {
+	return fmt.Sprintf("no instances found of %s:%s~%d#%s", e.Sector, e.Action, e.Version, e.Envelope)
+}
+
+func (e *NoInstancesError) Is(target error) bool { return target == ErrNoInstances }
+
+// VerificationError means a ticket, privilege or signature check failed
+type VerificationError struct {
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("verification failed: %s", e.Err)
+}
+
+func (e *VerificationError) Unwrap() error { return e.Err }
+
+func (e *VerificationError) Is(target error) bool { return target == ErrVerification }
+
+// RemoteError is an error reply from a service. Handlers can return one to control the
+// code and message of the reply.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+// NewRemoteError returns a RemoteError with the given code and message
+func NewRemoteError(code, message string) *RemoteError {
+	return &RemoteError{Code: code, Message: message}
+}
+
+func (e *RemoteError) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return e.Message
+}
+
+func (e *RemoteError) Is(target error) bool {
+	if target == ErrRemote {
+		return true
+	}
+	return target == ErrVerification && e.Code == ErrorCodeVerification
+}
+
+// Err returns the error carried by a reply, or nil if it is not an error reply
+func (msg *Message) Err() error {
+	if len(msg.Error) == 0 && len(msg.ErrorCode) == 0 {
+		return nil
+	}
+	if msg.transportError {
+		return &TransportError{Sent: true, Err: errors.New(msg.Error)}
+	}
+	return &RemoteError{Code: msg.ErrorCode, Message: msg.Error}
+}
+
+// errorReplyFields picks the ErrorCode and Error header values used to report err
+func errorReplyFields(err error) (code, text string) {
+	var remoteErr *RemoteError
+	var verificationErr *VerificationError
+
+	switch {
+	case errors.As(err, &remoteErr):
+		code = remoteErr.Code
+		text = remoteErr.Message
+	case errors.As(err, &verificationErr):
+		code = ErrorCodeVerification
+		text = verificationErr.Err.Error()
+	default:
+		code = ErrorCodeGeneral
+		text = err.Error()
+	}
+
+	if len(code) == 0 {
+		code = ErrorCodeGeneral
+	}
+	return
+}
+
+// NewErrorReply builds a well formed error reply to request from err
+func NewErrorReply(request *Message, err error) *Message {
+	code, text := errorReplyFields(err)
+
+	reply := NewResponseMessage()
+	reply.SetEnvelope(request.Envelope)
+	reply.SetRequestID(request.RequestID)
+	reply.SetErrorCode(code)
+	reply.SetError(text)
+	return reply
+}
+
+// ReplyWithError sends an error reply for message derived from err. RemoteErrors keep their
+// code, VerificationErrors are sent as ErrorCodeVerification and anything else as
+// ErrorCodeGeneral.
+func ReplyWithError(message *Message, client *Client, err error) {
+	code, _ := errorReplyFields(err)
+	ReplyOnError(message, client, code, err)
+}
+
+// requestError turns the context errors that end a request into the package's typed errors
+func requestError(err error, action string) error {
+	if err == context.DeadlineExceeded {
+		return &TimeoutError{Action: action, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package scamp
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+	var err error = requestError(context.DeadlineExceeded, "Foo.bar")
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timeouts should match ErrTimeout and context.DeadlineExceeded")
+	}
+
+	err = &NoInstancesError{Sector: "main", Action: "Foo.bar", Version: 1, Envelope: "json"}
+	if !errors.Is(err, ErrNoInstances) || errors.Is(err, ErrTransport) {
+		t.Errorf("NoInstancesError matched the wrong sentinel")
+	}
+
+	var remoteErr *RemoteError
+	err = &TransportError{Err: NewRemoteError("x", "y")}
+	if !errors.Is(err, ErrTransport) || !errors.As(err, &remoteErr) {
+		t.Errorf("TransportError should unwrap")
+	}
+
+	if !errors.Is(NewRemoteError(ErrorCodeVerification, "bad ticket"), ErrVerification) {
+		t.Errorf("verification replies should match ErrVerification")
+	}
+}
+
+func TestMessageErr(t *testing.T) {
+	msg := NewResponseMessage()
+	if msg.Err() != nil {
+		t.Fatalf("plain reply should carry no error")
+	}
+
+	msg.SetErrorCode("insufficient_funds")
+	msg.SetError("balance too low")
+
+	var remoteErr *RemoteError
+	if !errors.As(msg.Err(), &remoteErr) || remoteErr.Code != "insufficient_funds" || remoteErr.Message != "balance too low" {
+		t.Errorf("unexpected error: %v", msg.Err())
+	}
+
+	msg.transportError = true
+	if !errors.Is(msg.Err(), ErrTransport) {
+		t.Errorf("TXERR replies should be transport errors")
+	}
+}
+
+func TestNewErrorReply(t *testing.T) {
+	request := NewRequestMessage()
+	request.SetRequestID(12)
+
+	reply := NewErrorReply(request, &VerificationError{Err: errors.New("ticket expired")})
+	if reply.RequestID != 12 || reply.ErrorCode != ErrorCodeVerification || reply.Error != "ticket expired" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+
+	reply = NewErrorReply(request, errors.New("boom"))
+	if reply.ErrorCode != ErrorCodeGeneral || reply.Error != "boom" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+}
@@ -0,0 +1,83 @@
+package scamp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// JSONActionFunc is a typed action handler used with RegisterJSON
+type JSONActionFunc[Req, Resp any] func(ctx context.Context, request Req) (Resp, error)
+
+// RegisterJSON registers a typed JSON handler on serv. The request body is decoded into
+// Req before handler is called, and its result is encoded as the reply. A handler error
+// is sent as an error reply (see NewErrorReply); return a RemoteError to pick the code.
+// The handler's ctx is done once the caller's connection closes, including when the
+// service is torn down at the end of Shutdown.
+func RegisterJSON[Req, Resp any](serv *Service, name string, handler JSONActionFunc[Req, Resp], options *ActionOptions) error {
+	return serv.Register(name, func(message *Message, client *Client) {
+		reply, err := handleJSON(client.Context(), message, handler)
+		if err != nil {
+			reply = NewErrorReply(message, err)
+		}
+
+		_, err = client.Send(reply)
+		if err != nil {
+			Error.Printf("(messageID: %v, messageAction: %v) send error: %v\n", message.RequestID, message.Action, err)
+		}
+	}, options)
+}
+
+func handleJSON[Req, Resp any](ctx context.Context, message *Message, handler JSONActionFunc[Req, Resp]) (reply *Message, err error) {
+	var request Req
+	if body := message.Bytes(); len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			return nil, NewRemoteError(ErrorCodeBadRequest, fmt.Sprintf("could not decode request: %s", err))
+		}
+	}
+
+	response, err := handler(ctx, request)
+	if err != nil {
+		return
+	}
+
+	reply = NewResponseMessage()
+	reply.SetEnvelope(EnvelopeJSON)
+	reply.SetRequestID(message.RequestID)
+	_, err = reply.WriteJSON(response)
+	return
+}
+
+// Call sends request to sector:action~version using the default requester and decodes
+// the reply into Resp. Error replies are returned as *RemoteError.
+func Call[Req, Resp any](ctx context.Context, sector, action string, version int, request Req) (Resp, error) {
+	return CallWith[Req, Resp](ctx, defaultRequester, sector, action, version, request)
+}
+
+// CallWith is Call using an explicit Requester
+func CallWith[Req, Resp any](ctx context.Context, requester Requester, sector, action string, version int, request Req) (response Resp, err error) {
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction(action)
+	if len(sector) > 0 {
+		msg.SetAction(sector + ":" + action)
+	}
+	msg.SetVersion(version)
+
+	_, err = msg.WriteJSON(request)
+	if err != nil {
+		return
+	}
+
+	reply, err := requester.MakeJSONRequest(ctx, msg, 0, false)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(reply.Bytes(), &response)
+	if err != nil {
+		err = fmt.Errorf("could not decode reply from %s: %s", action, err)
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package scamp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type greetRequest struct {
+	Name string `json:"name"`
+}
+
+type greetResponse struct {
+	Greeting string `json:"greeting"`
+}
+
+func greet(ctx context.Context, request greetRequest) (response greetResponse, err error) {
+	if len(request.Name) == 0 {
+		err = NewRemoteError("missing_name", "name is required")
+		return
+	}
+	response.Greeting = "hello " + request.Name
+	return
+}
+
+func TestHandleJSON(t *testing.T) {
+	request := NewRequestMessage()
+	request.SetRequestID(7)
+	request.Write([]byte(`{"name":"world"}`))
+
+	reply, err := handleJSON(context.Background(), request, greet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var response greetResponse
+	err = json.Unmarshal(reply.Bytes(), &response)
+	if err != nil || response.Greeting != "hello world" || reply.RequestID != 7 {
+		t.Errorf("unexpected reply %s (%v)", reply.Bytes(), err)
+	}
+}
+
+func TestHandleJSONErrors(t *testing.T) {
+	var remoteErr *RemoteError
+
+	request := NewRequestMessage()
+	request.Write([]byte(`{"name":`))
+	_, err := handleJSON(context.Background(), request, greet)
+	if !errors.As(err, &remoteErr) || remoteErr.Code != ErrorCodeBadRequest {
+		t.Errorf("expected bad_request, got %v", err)
+	}
+
+	_, err = handleJSON(context.Background(), NewRequestMessage(), greet)
+	if !errors.As(err, &remoteErr) || remoteErr.Code != "missing_name" {
+		t.Errorf("expected handler error, got %v", err)
+	}
+}
+
+func TestCallWith(t *testing.T) {
+	requester := NewMockedScampRequester(map[string]string{
+		"Greeter.greet": `{"greeting":"hello mock"}`,
+	})
+
+	response, err := CallWith[greetRequest, greetResponse](context.Background(), requester, "", "Greeter.greet", 1, greetRequest{Name: "mock"})
+	if err != nil || response.Greeting != "hello mock" {
+		t.Errorf("unexpected response %+v (%v)", response, err)
+	}
+
+	_, err = CallWith[greetRequest, greetResponse](context.Background(), requester, "", "Greeter.missing", 1, greetRequest{})
+	if err == nil {
+		t.Errorf("expected an error for an unmocked action")
+	}
+}
+
+// waitForDone registers Test.wait on serv, a JSON handler that blocks until its ctx is
+// done. The returned channels report when a call starts and when its ctx ends.
+func waitForDone(t *testing.T, serv *Service) (started, done chan bool) {
+	started, done = make(chan bool, 1), make(chan bool, 1)
+	err := RegisterJSON(serv, "Test.wait", func(ctx context.Context, _ greetRequest) (response greetResponse, err error) {
+		started <- true
+		<-ctx.Done()
+		done <- true
+		return response, ctx.Err()
+	}, nil)
+	if err != nil {
+		t.Fatalf("register: %s", err)
+	}
+	return
+}
+
+func TestRegisterJSONContextEndsWithConnection(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	serv := newTestService()
+	started, done := waitForDone(t, serv)
+	go serv.Handle(server)
+
+	sendTestRequest(t, requester, "Test.wait")
+	<-started
+	requester.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the handler's ctx outlived the caller's connection")
+	}
+}
+
+func TestRegisterJSONContextEndsAtShutdownDeadline(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	serv := newTestService()
+	started, done := waitForDone(t, serv)
+	serv.clients = append(serv.clients, server)
+	go serv.Handle(server)
+
+	sendTestRequest(t, requester, "Test.wait")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	serv.Shutdown(ctx)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the handler's ctx outlived the shutdown deadline")
+	}
+}
@@ -19,6 +19,8 @@ type Message struct {
 	IdentifyingToken string
 	Error            string
 	ErrorCode        string
+	// set when the reply was cut short by a TXERR packet
+	transportError bool
 }
 
 // NewMessage creates a new scamp message
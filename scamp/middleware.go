@@ -0,0 +1,83 @@
+package scamp
+
+import (
+	"errors"
+	"time"
+)
+
+// Middleware wraps an action handler. It can act before and after calling next, or
+// reply on its own without calling next at all.
+type Middleware func(next ServiceActionFunc) ServiceActionFunc
+
+// chainMiddleware wraps handler so that middleware[0] runs first
+func chainMiddleware(handler ServiceActionFunc, middleware []Middleware) ServiceActionFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Use adds middleware that runs around every action of the service, outside any
+// per-action middleware. Middleware runs in the order it was added. It must be called
+// before the service starts handling requests.
+func (serv *Service) Use(middleware ...Middleware) (err error) {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	if serv.isRunning || serv.middlewareSealed {
+		err = errors.New("cannot add middleware while server is running")
+		return
+	}
+
+	serv.middleware = append(serv.middleware, middleware...)
+	return
+}
+
+// handlerFor returns the fully wrapped handler for action. The service middleware is
+// fixed the first time any action is handled.
+func (serv *Service) handlerFor(action *ServiceAction) ServiceActionFunc {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	serv.middlewareSealed = true
+	if action.handler == nil {
+		action.handler = chainMiddleware(action.callback, serv.middleware)
+	}
+	return action.handler
+}
+
+// VerifyTicketMiddleware checks the request's ticket and privileges against options
+// before calling the handler, replying with a verification error if they fail. It does
+// nothing when options neither sets Verify nor lists Privs.
+func VerifyTicketMiddleware(options ActionOptions) Middleware {
+	return func(next ServiceActionFunc) ServiceActionFunc {
+		if !options.Verify && len(options.Privs) == 0 {
+			return next
+		}
+
+		return BasicActionFunc(func(message *Message, client *Client) {
+			ticket, err := VerifyTicket(message.Ticket, options.TicketVerifyPublicKey)
+			if err != nil {
+				ReplyWithError(message, client, &VerificationError{Err: err})
+				return
+			}
+
+			err = ticket.CheckPrivs(options.Privs)
+			if err != nil {
+				ReplyWithError(message, client, &VerificationError{Err: err})
+				return
+			}
+
+			next.Call(message, client)
+		})
+	}
+}
+
+// LoggingMiddleware logs each request and how long its handler took
+func LoggingMiddleware(next ServiceActionFunc) ServiceActionFunc {
+	return BasicActionFunc(func(message *Message, client *Client) {
+		start := time.Now()
+		next.Call(message, client)
+		Info.Printf("`%s` (request %d, client %d): handled in %s", message.Action, message.RequestID, message.ClientID, time.Since(start))
+	})
+}
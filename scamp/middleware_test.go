@@ -0,0 +1,53 @@
+package scamp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next ServiceActionFunc) ServiceActionFunc {
+		return BasicActionFunc(func(message *Message, client *Client) {
+			*calls = append(*calls, name)
+			next.Call(message, client)
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	serv := &Service{actions: make(map[string]*ServiceAction)}
+
+	serv.Use(recordingMiddleware("outer", &calls), recordingMiddleware("inner", &calls))
+	err := serv.Register("Test.action", func(*Message, *Client) {
+		calls = append(calls, "handler")
+	}, &ActionOptions{Middleware: []Middleware{recordingMiddleware("action", &calls)}})
+	if err != nil {
+		t.Fatalf("register failed: %s", err)
+	}
+
+	serv.handlerFor(serv.actions[actionKey("Test.action", 1)]).Call(NewRequestMessage(), nil)
+
+	expected := []string{"outer", "inner", "action", "handler"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+
+	if serv.Use(LoggingMiddleware) == nil {
+		t.Errorf("expected Use to fail once requests are being handled")
+	}
+}
+
+func TestVerifyTicketMiddlewareStopsChain(t *testing.T) {
+	initSCAMPLogger()
+	called := false
+	handler := VerifyTicketMiddleware(ActionOptions{Verify: true})(BasicActionFunc(func(*Message, *Client) {
+		called = true
+	}))
+
+	// a nil client means the error reply is dropped
+	handler.Call(NewRequestMessage(), nil)
+	if called {
+		t.Errorf("handler should not run without a valid ticket")
+	}
+}
@@ -3,15 +3,19 @@ package scamp
 import (
 	"context"
 	"fmt"
+	"sync"
 )
 
-// Extremely simple mock for ScampRequester
+// Extremely simple mock for Requester
 // mockRequests are maps with keys as paths (aka 'actions') and values as json strings
 type mockedScampRequester struct {
 	mockRequests map[string]string
 	mockErrors   []error
+	errorsM      sync.Mutex
 }
 
+var _ Requester = (*mockedScampRequester)(nil)
+
 func NewMockedScampRequester(mocks map[string]string) *mockedScampRequester {
 	return &mockedScampRequester{
 		mockRequests: mocks,
@@ -33,14 +37,18 @@ func (r *mockedScampRequester) getMockedResponse(action string) (*Message, error
 }
 
 func (r *mockedScampRequester) MockErrors() []error {
+	r.errorsM.Lock()
+	defer r.errorsM.Unlock()
 	return r.mockErrors
 }
 
 func (r *mockedScampRequester) addError(err error) {
+	r.errorsM.Lock()
+	defer r.errorsM.Unlock()
 	r.mockErrors = append(r.mockErrors, err)
 }
 
-// MakeJSONRequest - required to satisfy the ScampRequester interface definition
+// MakeJSONRequest - required to satisfy the Requester interface definition
 func (r *mockedScampRequester) MakeJSONRequest(ctx context.Context, mssg *Message, _ int, _ bool) (*Message, error) {
 
 	response, err := r.getMockedResponse(mssg.Action)
@@ -54,7 +62,7 @@ func (r *mockedScampRequester) MakeJSONRequest(ctx context.Context, mssg *Messag
 	return response, nil
 }
 
-// MakeChannelJSONRequest - required to satisfy the ScampRequester interface definition
+// MakeChannelJSONRequest - required to satisfy the Requester interface definition
 func (r *mockedScampRequester) MakeChannelJSONRequest(
 	c context.Context,
 	m *Message,
@@ -63,5 +71,13 @@ func (r *mockedScampRequester) MakeChannelJSONRequest(
 	ch chan *Message,
 	er chan error,
 ) {
-	panic("MakeChannelJSONRequest NOT YET SUPPORTED")
+	go func() {
+		deliverCtx, cancelDelivery := context.WithTimeout(c, requestTimeout(t)+replyDeliveryGrace)
+		defer cancelDelivery()
+
+		ctx, cancel := context.WithTimeout(c, requestTimeout(t))
+		response, err := r.MakeJSONRequest(ctx, m, t, al)
+		cancel()
+		deliverReply(deliverCtx, response, err, ch, er)
+	}()
 }
@@ -3,6 +3,7 @@ package scamp
 import (
 	"context"
 	"testing"
+	"time"
 )
 
 func TestMockedScampRequester(t *testing.T) {
@@ -33,3 +34,78 @@ func TestMockedScampRequester(t *testing.T) {
 	}
 
 }
+
+func TestMockedScampRequesterChannel(t *testing.T) {
+	r := NewMockedScampRequester(map[string]string{
+		"kids.tv.remote.fetch": `{"channel_id":123}`,
+	})
+
+	replies := make(chan *Message)
+	errs := make(chan error)
+
+	mssg := NewMessage()
+	mssg.SetAction("kids.tv.remote.fetch")
+	r.MakeChannelJSONRequest(context.Background(), mssg, 1, false, replies, errs)
+
+	select {
+	case recv := <-replies:
+		if string(recv.Bytes()) != `{"channel_id":123}` {
+			t.Errorf("wrong response: %s", recv.Bytes())
+		}
+	case err := <-errs:
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for reply")
+	}
+
+	mssg = NewMessage()
+	mssg.SetAction("bank.funds.withdraw")
+	r.MakeChannelJSONRequest(context.Background(), mssg, 1, false, replies, errs)
+
+	select {
+	case <-replies:
+		t.Fatalf("expected an error for an unmocked action")
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for error")
+	}
+}
+
+func TestMockedChannelDeliversAfterTimeout(t *testing.T) {
+	r := NewMockedScampRequester(map[string]string{})
+	replies := make(chan *Message)
+	errs := make(chan error)
+
+	mssg := NewMessage()
+	mssg.SetAction("bank.funds.withdraw")
+	r.MakeChannelJSONRequest(context.Background(), mssg, 1, false, replies, errs)
+
+	// read only after the request's timeout has passed
+	time.Sleep(1100 * time.Millisecond)
+	select {
+	case <-errs:
+	case <-replies:
+		t.Fatalf("expected an error for an unmocked action")
+	case <-time.After(time.Second):
+		t.Fatalf("the error was dropped")
+	}
+}
+
+func TestMockedChannelGivesUpOnDroppedReceiver(t *testing.T) {
+	r := NewMockedScampRequester(map[string]string{})
+	replies := make(chan *Message)
+	errs := make(chan error)
+
+	mssg := NewMessage()
+	mssg.SetAction("bank.funds.withdraw")
+	r.MakeChannelJSONRequest(context.Background(), mssg, 1, false, replies, errs)
+
+	time.Sleep(time.Second + replyDeliveryGrace + 200*time.Millisecond)
+	select {
+	case <-errs:
+		t.Errorf("the error should have been abandoned")
+	case <-replies:
+		t.Errorf("expected an error for an unmocked action")
+	default:
+	}
+}
@@ -6,13 +6,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 const (
 	theRestSize = 5
 )
 
-var packetSeenSinceBoot = 0
+// packetSeenSinceBoot counts packets read by every connection, so it is only touched atomically
+var packetSeenSinceBoot uint64
 
 // Packet represents a message packet
 type Packet struct {
@@ -110,7 +112,7 @@ func ReadPacket(reader *bufio.ReadWriter) (pkt *Packet, err error) {
 	}
 
 	// Trace.Printf("(%d) done reading packet", packetSeenSinceBoot)
-	packetSeenSinceBoot = packetSeenSinceBoot + 1
+	atomic.AddUint64(&packetSeenSinceBoot, 1)
 	return pkt, nil
 }
 
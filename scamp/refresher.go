@@ -3,6 +3,7 @@ package scamp
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +16,9 @@ type CacheRefresher struct {
 	context context.Context
 	running int32
 	due     *time.Ticker
+	// set while the cache file is being watched, which makes reactive refreshes
+	// unnecessary
+	watching int32
 
 	initialRefresh bool
 	options        RefresherOptions
@@ -26,6 +30,12 @@ type RefresherOptions struct {
 	// Call cache.Refresh when functions are called
 	// Defaults to `true`
 	Reactive bool
+	// Refresh when the cache file changes on disk instead of on a timer. Falls back
+	// to polling every WaitDuration where file watching is unavailable.
+	Watch bool
+	// How long the cache file must be quiet before a watched refresh
+	// Defaults to `100 * time.Millisecond`
+	WatchDebounce *time.Duration
 }
 
 func NewCacheRefresher(cache *ServiceCache, options RefresherOptions) *CacheRefresher {
@@ -52,7 +62,7 @@ func (refresher *CacheRefresher) Reactive() bool {
 }
 
 func (refresher *CacheRefresher) Run(ctx context.Context) {
-	if refresher.Reactive() {
+	if refresher.Reactive() && !refresher.options.Watch {
 		return
 	}
 
@@ -74,6 +84,13 @@ func (refresher *CacheRefresher) Run(ctx context.Context) {
 
 		refresher.initialRefresh = true
 
+		if refresher.options.Watch {
+			refresher.watch()
+			if refresher.context.Err() != nil || refresher.Reactive() {
+				return
+			}
+		}
+
 		for {
 			select {
 			case <-refresher.context.Done():
@@ -86,6 +103,22 @@ func (refresher *CacheRefresher) Run(ctx context.Context) {
 	}()
 }
 
+// watch refreshes the cache whenever its file changes until the refresher is stopped
+func (refresher *CacheRefresher) watch() {
+	debounce := 100 * time.Millisecond
+	if refresher.options.WatchDebounce != nil {
+		debounce = *refresher.options.WatchDebounce
+	}
+
+	atomic.StoreInt32(&refresher.watching, 1)
+	defer atomic.StoreInt32(&refresher.watching, 0)
+
+	err := watchCacheFile(refresher.context, refresher.cache.path, debounce, refresher.markRefresh)
+	if err != nil {
+		Error.Printf("watch cache: %v", err)
+	}
+}
+
 func (refresher *CacheRefresher) markRefresh() {
 	err := refresher.cache.Refresh()
 	if err != nil {
@@ -126,7 +159,7 @@ func (refresher *CacheRefresher) Due() bool {
 }
 
 func (refresher *CacheRefresher) ReactiveRefresh() {
-	if refresher.Reactive() && refresher.Due() {
+	if refresher.Reactive() && atomic.LoadInt32(&refresher.watching) == 0 && refresher.Due() {
 		refresher.markRefresh()
 	}
 }
@@ -145,6 +178,30 @@ func (refresher *CacheRefresher) EnableRecordVerification() {
 	refresher.cache.EnableRecordVerification()
 }
 
+func (refresher *CacheRefresher) SetClientCertificate(cert tls.Certificate) {
+	refresher.lock.RLock()
+	defer refresher.lock.RUnlock()
+	refresher.cache.SetClientCertificate(cert)
+}
+
+func (refresher *CacheRefresher) EnableStaleSweep(intervals float64) {
+	refresher.lock.RLock()
+	defer refresher.lock.RUnlock()
+	refresher.cache.EnableStaleSweep(intervals)
+}
+
+func (refresher *CacheRefresher) DisableStaleSweep() {
+	refresher.lock.RLock()
+	defer refresher.lock.RUnlock()
+	refresher.cache.DisableStaleSweep()
+}
+
+func (refresher *CacheRefresher) Subscribe(fn func(CacheEvent)) (unsubscribe func()) {
+	refresher.lock.RLock()
+	defer refresher.lock.RUnlock()
+	return refresher.cache.Subscribe(fn)
+}
+
 func (refresher *CacheRefresher) Store(instance *serviceProxy) {
 	refresher.lock.RLock()
 	defer refresher.lock.RUnlock()
@@ -0,0 +1,102 @@
+package scamp
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeCacheFile(t *testing.T, path string, announcements ...[]byte) {
+	var buf bytes.Buffer
+	for _, announcement := range announcements {
+		buf.Write(sep)
+		buf.Write(newline)
+		buf.Write(announcement)
+	}
+	err := os.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("write cache: %s", err)
+	}
+}
+
+func TestRefreshSkipsUnchangedFile(t *testing.T) {
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	path := filepath.Join(t.TempDir(), "discovery.cache")
+	writeCacheFile(t, path, announcementOf(t, serv))
+
+	cache, _ := NewServiceCache(path)
+	err := cache.Refresh()
+	if err != nil || cache.Size() != 1 {
+		t.Fatalf("expected one instance, got %d (%v)", cache.Size(), err)
+	}
+
+	// same size and modification time: the contents are not read again
+	stat, _ := os.Stat(path)
+	garbage := bytes.Repeat([]byte("x"), int(stat.Size()))
+	os.WriteFile(path, garbage, 0644)
+	os.Chtimes(path, stat.ModTime(), stat.ModTime())
+
+	err = cache.Refresh()
+	if err != nil || cache.Size() != 1 {
+		t.Fatalf("an unchanged file should not be parsed, got %d (%v)", cache.Size(), err)
+	}
+
+	writeCacheFile(t, path)
+	err = cache.Refresh()
+	if err != nil || cache.Size() != 0 {
+		t.Fatalf("a changed file should be parsed, got %d (%v)", cache.Size(), err)
+	}
+}
+
+func TestRefresherWatchesAtomicRename(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cache watching needs inotify")
+	}
+	initSCAMPLogger()
+	serv := newAnnouncedTestService(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "discovery.cache")
+	writeCacheFile(t, path)
+
+	cache, _ := NewServiceCache(path)
+	wait := time.Hour
+	debounce := 10 * time.Millisecond
+	refresher := NewCacheRefresher(cache, RefresherOptions{
+		WaitDuration:  &wait,
+		Reactive:      true,
+		Watch:         true,
+		WatchDebounce: &debounce,
+	})
+
+	events := make(chan CacheEvent, 4)
+	refresher.Subscribe(func(event CacheEvent) {
+		events <- event
+	})
+
+	refresher.Run(context.Background())
+	defer refresher.Stop()
+
+	// give the watcher a moment to be set up before replacing the file
+	time.Sleep(50 * time.Millisecond)
+
+	staged := filepath.Join(dir, "discovery.cache.new")
+	writeCacheFile(t, staged, announcementOf(t, serv))
+	err := os.Rename(staged, path)
+	if err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != CacheAdded || event.Ident != "announced-1234" {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the renamed cache file was not picked up")
+	}
+}
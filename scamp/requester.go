@@ -1,122 +1,663 @@
 package scamp
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math/rand"
 	"sort"
+	"strings"
 	"time"
 )
 
 const (
+	// MAX_RETRIES is no longer used.
+	//
+	// Deprecated: failover is configured with ScampRequester.Retry (see RetryPolicy).
 	MAX_RETRIES = 20
 )
 
+// defaultSector is used when a request does not name a sector
+const defaultSector = "main"
+
+// Requester makes SCAMP requests. Code that calls other services should depend on a
+// Requester rather than the package-level functions so that tests can swap in
+// NewMockedScampRequester.
+type Requester interface {
+	// MakeJSONRequest sends msg to an instance announcing msg.Action and msg.Version and
+	// waits at most timeoutSeconds for the reply; zero means the timeout the action
+	// announces, or DefaultRequestTimeout. When retry is true the request is
+	// considered safe to repeat and may be resent to another instance if the first one
+	// drops the connection before replying.
+	MakeJSONRequest(ctx context.Context, msg *Message, timeoutSeconds int, retry bool) (*Message, error)
+
+	// MakeChannelJSONRequest is the non-blocking form of MakeJSONRequest. It returns at
+	// once and later delivers exactly one result: the reply on replies or the failure,
+	// timeouts included, on errs. Delivery waits for a receiver until ctx is done or
+	// the request timeout plus a short grace period has passed, whichever comes first.
+	MakeChannelJSONRequest(ctx context.Context, msg *Message, timeoutSeconds int, retry bool, replies chan *Message, errs chan error)
+}
+
+// DefaultRequestTimeout bounds requests made with a timeout of zero to actions that
+// don't announce a timeout
+var DefaultRequestTimeout = 75 * time.Second
+
+func requestTimeout(timeoutSeconds int) time.Duration {
+	if timeoutSeconds > 0 {
+		return time.Duration(timeoutSeconds) * time.Second
+	}
+	return DefaultRequestTimeout
+}
+
+// ScampRequester is the production Requester. Instances are looked up in the service
+// cache and reached over the pooled client of each serviceProxy.
+type ScampRequester struct {
+	// Sector is used when msg.Action has no `sector:` prefix. Defaults to "main".
+	Sector string
+	// Retry is applied to idempotent requests
+	Retry RetryPolicy
+	// Balancer orders the instances of an action. Defaults to DefaultBalancer.
+	Balancer Balancer
+	// Breakers tracks failing instances so they can be ejected. Defaults to DefaultBreakers.
+	Breakers *BreakerRegistry
+
+	cache *CacheRefresher
+}
+
+// RetryPolicy controls how idempotent requests fail over between instances
+type RetryPolicy struct {
+	// Attempts is the total number of tries, including the first one
+	Attempts int
+	// Backoff is the pause before the first retry. It doubles on every following
+	// retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used by NewScampRequester
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:   3,
+		Backoff:    50 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+}
+
+// backoff returns how long to wait before the given attempt (attempt 2 is the first retry)
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	wait := policy.Backoff
+	for i := 2; i < attempt; i++ {
+		wait *= 2
+		if policy.MaxBackoff > 0 && wait >= policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+	return wait
+}
+
+// RequestOptions tune a single request made with MakeJSONRequestWithOptions
+type RequestOptions struct {
+	// Timeout bounds the whole request, retries included. Defaults to the timeout the
+	// action announces, or DefaultRequestTimeout if it announces none.
+	Timeout time.Duration
+	// Idempotent marks the action as safe to repeat. Only idempotent requests are
+	// resent after the message went out, following the requester's RetryPolicy.
+	Idempotent bool
+	// Balancer overrides the requester's Balancer for this request
+	Balancer Balancer
+	// HedgeDelay, when positive, sends a second copy of an idempotent request to another
+	// instance if no reply has arrived after this long. The first reply wins. Ignored
+	// unless Idempotent is set, and only used when the instances involved announce the
+	// action as read or FlagIdempotent.
+	HedgeDelay time.Duration
+}
+
+// NewScampRequester returns a ScampRequester backed by DefaultCache
+func NewScampRequester() *ScampRequester {
+	return &ScampRequester{
+		Sector: defaultSector,
+		Retry:  DefaultRetryPolicy(),
+	}
+}
+
+// NewScampRequesterWithCache returns a ScampRequester backed by an explicit cache
+func NewScampRequesterWithCache(cache *CacheRefresher) *ScampRequester {
+	requester := NewScampRequester()
+	requester.cache = cache
+	return requester
+}
+
+var defaultRequester = NewScampRequester()
+
+// MakeJSONRequest implements Requester. The target sector may be given as a prefix
+// of the action (`background:Foo.bar`); the version is taken from msg.Version.
+func (r *ScampRequester) MakeJSONRequest(ctx context.Context, msg *Message, timeoutSeconds int, retry bool) (*Message, error) {
+	return r.MakeJSONRequestWithOptions(ctx, msg, RequestOptions{
+		Timeout:    time.Duration(timeoutSeconds) * time.Second,
+		Idempotent: retry,
+	})
+}
+
+// MakeJSONRequestWithOptions is MakeJSONRequest with per-request options
+func (r *ScampRequester) MakeJSONRequestWithOptions(ctx context.Context, msg *Message, options RequestOptions) (message *Message, err error) {
+	sector, action := splitSectorAction(msg.Action, r.Sector)
+	version := msg.Version
+	if version == 0 {
+		version = 1
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeoutFor(sector, action, version, msg.Envelope, options.Timeout))
+	defer cancel()
+
+	req := &outgoingRequest{
+		sector:   sector,
+		action:   action,
+		version:  version,
+		msg:      msg,
+		balancer: r.balancer(options.Balancer),
+	}
+
+	if !options.Idempotent {
+		message, _, err = r.request(ctx, req)
+		err = requestError(err, action)
+		return
+	}
+
+	req.hedgeDelay = options.HedgeDelay
+	req.tried = make(map[string]bool)
+	policy := r.Retry
+	var lastErr error
+
+	err = DoLimit(policy.Attempts, func(attempt int) (retry bool, err error) {
+		if attempt > 1 {
+			err = sleepContext(ctx, policy.backoff(attempt))
+			if err != nil {
+				return false, err
+			}
+		}
+
+		var ident string
+		message, ident, err = r.request(ctx, req)
+		if err == nil {
+			return false, nil
+		}
+		lastErr = err
+
+		if len(ident) > 0 {
+			req.tried[ident] = true
+		}
+		if !isRetryable(err) {
+			return false, err
+		}
+
+		Error.Printf("%s:%s~%d attempt %d failed on `%s`: %s", sector, action, version, attempt, ident, err)
+		return true, err
+	})
+	if IsMaxRetries(err) {
+		err = lastErr
+	}
+	err = requestError(err, action)
+
+	return
+}
+
+// sleepContext pauses for d, returning early with ctx.Err() if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MakeChannelJSONRequest implements Requester
+func (r *ScampRequester) MakeChannelJSONRequest(
+	ctx context.Context,
+	msg *Message,
+	timeoutSeconds int,
+	retry bool,
+	replies chan *Message,
+	errs chan error,
+) {
+	sector, action := splitSectorAction(msg.Action, r.Sector)
+	version := msg.Version
+	if version == 0 {
+		version = 1
+	}
+	timeout := r.timeoutFor(sector, action, version, msg.Envelope, time.Duration(timeoutSeconds)*time.Second)
+
+	go func() {
+		deliverCtx, cancel := context.WithTimeout(ctx, timeout+replyDeliveryGrace)
+		defer cancel()
+
+		message, err := r.MakeJSONRequestWithOptions(ctx, msg, RequestOptions{Timeout: timeout, Idempotent: retry})
+		deliverReply(deliverCtx, message, err, replies, errs)
+	}()
+}
+
+// replyDeliveryGrace is how long past the request timeout a channel request waits for
+// the caller to take its result before giving up on it
+const replyDeliveryGrace = time.Second
+
+// deliverReply hands the outcome of a request to whoever is reading replies or errs.
+// ctx must outlast the request timeout, since a timed out request still has its error
+// to deliver; channel requests allow replyDeliveryGrace on top. Delivery is abandoned
+// once ctx is done, so a caller that stops reading can't strand the goroutine.
+func deliverReply(ctx context.Context, message *Message, err error, replies chan *Message, errs chan error) {
+	if err != nil {
+		select {
+		case errs <- err:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	select {
+	case replies <- message:
+	case <-ctx.Done():
+	}
+}
+
+// balancer picks the Balancer for a request: the per-request override, then the
+// requester's own, then DefaultBalancer
+func (r *ScampRequester) balancer(override Balancer) Balancer {
+	if override != nil {
+		return override
+	}
+	if r.Balancer != nil {
+		return r.Balancer
+	}
+	return DefaultBalancer
+}
+
+// timeoutFor picks how long to wait for a reply: the caller's timeout if given, else the
+// longest timeout announced for the action by any instance (a tNNN flag), else
+// DefaultRequestTimeout
+func (r *ScampRequester) timeoutFor(sector, action string, version int, envelope envelopeFormat, requested time.Duration) (timeout time.Duration) {
+	if requested > 0 {
+		return requested
+	}
+
+	timeout = DefaultRequestTimeout
+	cache := r.serviceCache()
+	msgType, err := envelopeName(envelope)
+	if cache == nil || err != nil {
+		return
+	}
+
+	serviceProxies, err := cache.SearchByAction(sector, action, version, msgType)
+	if err != nil {
+		return
+	}
+
+	var announced time.Duration
+	for _, serviceProxy := range serviceProxies {
+		description, ok := serviceProxy.findAction(sector, action, version)
+		if ok && description.Timeout() > announced {
+			announced = description.Timeout()
+		}
+	}
+	if announced > 0 {
+		timeout = announced
+	}
+	return
+}
+
+// envelopeName is the name an envelope is indexed under in the service cache
+func envelopeName(envelope envelopeFormat) (name string, err error) {
+	switch envelope {
+	case EnvelopeJSON:
+		name = "json"
+	case EnvelopeJSONSTORE:
+		name = "jsonstore"
+	default:
+		err = fmt.Errorf("unsupported envelope type: `%d`", envelope)
+	}
+	return
+}
+
+func (r *ScampRequester) breakers() *BreakerRegistry {
+	if r.Breakers != nil {
+		return r.Breakers
+	}
+	return DefaultBreakers
+}
+
+func (r *ScampRequester) serviceCache() *CacheRefresher {
+	if r.cache != nil {
+		return r.cache
+	}
+	return DefaultCache
+}
+
+// splitSectorAction separates an optional `sector:` prefix from action
+func splitSectorAction(action, fallbackSector string) (sector, name string) {
+	sector = fallbackSector
+	if len(sector) == 0 {
+		sector = defaultSector
+	}
+
+	name = action
+	if i := strings.Index(action, ":"); i != -1 {
+		sector = action[:i]
+		name = action[i+1:]
+	}
+	return
+}
+
 // MakeJSONRequest retreives the appropriate service proxy based on the message action, and makes a
 // JSON request.
+//
+// Deprecated: use MakeJSONRequestContext, which can be cancelled by the caller.
 func MakeJSONRequest(
 	sector, action string, version int, msg *Message, timeoutSeconds int,
 ) (message *Message, err error) {
-	var msgType string
-	if msg.Envelope == EnvelopeJSON {
-		msgType = "json"
-	} else if msg.Envelope == EnvelopeJSONSTORE {
-		msgType = "jsonstore"
-	} else {
-		err = fmt.Errorf("unsupported envelope type: `%d`", msg.Envelope)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	return MakeJSONRequestContext(ctx, sector, action, version, msg)
+}
+
+// MakeJSONRequestContext is MakeJSONRequest driven by a context instead of a timeout.
+// If ctx is cancelled before a reply arrives, the reply slot is released and ctx.Err()
+// is returned; if its deadline passes, the error is a *TimeoutError.
+func MakeJSONRequestContext(
+	ctx context.Context, sector, action string, version int, msg *Message,
+) (message *Message, err error) {
+	message, _, err = defaultRequester.request(ctx, &outgoingRequest{
+		sector:   sector,
+		action:   action,
+		version:  version,
+		msg:      msg,
+		balancer: defaultRequester.balancer(nil),
+	})
+	err = requestError(err, action)
+	return
+}
+
+// errNoCache means a ScampRequester has no cache to look instances up in
+var errNoCache = errors.New("scamp: no discovery cache, call Initialize or use NewScampRequesterWithCache")
+
+// outgoingRequest carries one request through its attempts
+type outgoingRequest struct {
+	sector   string
+	action   string
+	version  int
+	msg      *Message
+	balancer Balancer
+	// hedgeDelay, if positive, sends a second copy after this long without a reply
+	hedgeDelay time.Duration
+	// tried holds idents that already failed this request
+	tried map[string]bool
+}
+
+// request does a single lookup-send-wait round and reports the ident of the instance that
+// answered (or, on failure, of the last instance that failed). Instances in req.tried are
+// only used when no other instance is available.
+func (r *ScampRequester) request(ctx context.Context, req *outgoingRequest) (message *Message, ident string, err error) {
+	msg := req.msg
+
+	msgType, err := envelopeName(msg.Envelope)
+	if err != nil {
 		return
 	}
 
-	//TODO: add retry logic in case service proxies are nil
-	var serviceProxies []*serviceProxy
-
-	serviceProxies, err = DefaultCache.SearchByAction(sector, action, version, msgType)
+	err = ctx.Err()
 	if err != nil {
 		return
 	}
-	if len(serviceProxies) == 0 {
-		err = fmt.Errorf("could not find %s:%s~%d#%s", sector, action, version, msgType)
+
+	cache := r.serviceCache()
+	if cache == nil {
+		err = errNoCache
 		return
 	}
 
-	msg.SetAction(action)
-	msg.SetVersion(version)
+	var serviceProxies []*serviceProxy
 
-	sent := false
-	var responseChan chan *Message
+	serviceProxies, err = cache.SearchByAction(req.sector, req.action, req.version, msgType)
+	var noInstances *NoInstancesError
+	if errors.As(err, &noInstances) || (err == nil && len(serviceProxies) == 0) {
+		err = &NoInstancesError{Sector: req.sector, Action: req.action, Version: req.version, Envelope: msgType}
+		return
+	} else if err != nil {
+		err = fmt.Errorf("look up %s:%s~%d: %w", req.sector, req.action, req.version, err)
+		return
+	}
 
-	var clients []*Client
-	for _, serviceProxy := range serviceProxies {
-		if serviceProxy != nil {
-			client, clientErr := serviceProxy.GetClient()
-			if clientErr != nil {
-				Error.Printf("GetClient failed for %s (%s): %s", serviceProxy.Ident(), serviceProxy.ConnSpec(), clientErr)
-				err = clientErr
-				continue
-			}
-			if client == nil {
-				Error.Printf("GetClient returned nil client for %s (%s)", serviceProxy.Ident(), serviceProxy.ConnSpec())
-				continue
-			}
+	msg.SetAction(req.action)
+	msg.SetVersion(req.version)
 
-			clients = append(clients, client)
+	breakers := r.breakers()
+	ordered := triedLast(breakers.partitionEjected(orderInstances(req.balancer, serviceProxies)), req.tried)
+
+	client, responseChan, ident, err := sendToFirstAvailable(ordered, msg, breakers)
+	if err != nil {
+		err = &TransportError{Ident: ident, Err: fmt.Errorf("Request failed: %s.%s not found: %s", req.sector, req.action, err)}
+		return
+	}
+	primary := inflightRequest{client: client, requestID: msg.RequestID, replies: responseChan, ident: ident}
+
+	if req.hedgeDelay > 0 {
+		others := hedgeTargets(ordered, ident, req)
+		if len(others) > 0 {
+			return hedge(ctx, primary, others, req.hedgeDelay, msg, breakers)
 		}
 	}
 
-	rand.Shuffle(len(clients), func(i, j int) {
-		clients[i], clients[j] = clients[j], clients[i]
-	})
+	message, err = waitForReply(ctx, client, primary.requestID, responseChan)
+	breakers.record(ident, err)
+	return
+}
 
-	// Sort based on queue depth.
-	sort.Slice(clients, func(i, j int) bool {
-		ilen := len(clients[i].openReplies)
-		jlen := len(clients[j].openReplies)
-		return ilen < jlen
-	})
+// inflightRequest is a message that was sent and is awaiting its reply
+type inflightRequest struct {
+	client    *Client
+	requestID int
+	replies   chan *Message
+	ident     string
+}
 
-	for _, client := range clients {
-		responseChan, err = client.Send(msg)
-		if err == nil {
-			sent = true
-			break
-		}
-	}
+type hedgeResult struct {
+	from    inflightRequest
+	message *Message
+	err     error
+}
 
-	if !sent {
-		err = fmt.Errorf("Request failed: %s.%s not found: %s", sector, action, err)
-		return
+// hedge waits for primary's reply. If none arrives within delay, or primary's connection
+// drops first, msg is sent again to the first usable instance in others and whichever
+// reply comes back first wins. The loser's reply slot is released.
+func hedge(
+	ctx context.Context, primary inflightRequest, others []*serviceProxy, delay time.Duration, msg *Message, breakers *BreakerRegistry,
+) (message *Message, ident string, err error) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	wait := func(sent inflightRequest) {
+		message, err := waitForReply(waitCtx, sent.client, sent.requestID, sent.replies)
+		results <- hedgeResult{from: sent, message: message, err: err}
 	}
 
-	timeout := time.After(time.Duration(timeoutSeconds) * time.Second)
-RetryLoop:
-	for attempts := 0; attempts < MAX_RETRIES; attempts++ {
-		if responseChan == nil {
-			err = fmt.Errorf("response channel is nil")
+	pending := map[int]inflightRequest{0: primary}
+	go wait(primary)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedgeC := timer.C
+
+	sendHedge := func() {
+		hedgeC = nil
+		client, responseChan, hedgeIdent, sendErr := sendToFirstAvailable(others, msg, breakers)
+		if sendErr != nil {
+			Error.Printf("could not hedge %s: %s", msg.Action, sendErr)
 			return
 		}
 
+		sent := inflightRequest{client: client, requestID: msg.RequestID, replies: responseChan, ident: hedgeIdent}
+		pending[1] = sent
+		go wait(sent)
+	}
+
+	for len(pending) > 0 {
 		select {
-		case respMsg, ok := <-responseChan:
-			if !ok && respMsg == nil {
-				break RetryLoop
+		case <-hedgeC:
+			sendHedge()
+		case result := <-results:
+			for key, sent := range pending {
+				if sent == result.from {
+					delete(pending, key)
+				}
 			}
 
-			if respMsg == nil {
-				continue RetryLoop
+			ident = result.from.ident
+			message, err = result.message, result.err
+			breakers.record(ident, err)
+			if message != nil {
+				// the losers' waits see waitCtx cancelled and drop their reply slots
+				for _, loser := range pending {
+					breakers.record(loser.ident, context.Canceled)
+				}
+				return
 			}
 
-			message = respMsg
-			return
-		case <-timeout:
-			//close(responseChan)
-			err = fmt.Errorf("request timed out")
+			if hedgeC != nil && isRetryable(err) {
+				sendHedge()
+			}
+		}
+	}
+
+	return
+}
+
+// withoutIdent returns ordered minus the instance named ident
+func withoutIdent(ordered []*serviceProxy, ident string) []*serviceProxy {
+	others := make([]*serviceProxy, 0, len(ordered))
+	for _, serviceProxy := range ordered {
+		if serviceProxy != nil && serviceProxy.Ident() != ident {
+			others = append(others, serviceProxy)
+		}
+	}
+	return others
+}
+
+// hedgeTargets returns the instances other than primary that a hedged copy of req may
+// go to. A request is only hedged when the instances announce its action as idempotent:
+// the caller's flag alone can't tell whether running it twice is safe.
+func hedgeTargets(ordered []*serviceProxy, primary string, req *outgoingRequest) (others []*serviceProxy) {
+	announcesIdempotent := func(instance *serviceProxy) bool {
+		description, ok := instance.findAction(req.sector, req.action, req.version)
+		return ok && description.Idempotent()
+	}
+
+	for _, instance := range ordered {
+		if instance == nil {
+			continue
+		}
+		if instance.Ident() == primary {
+			if !announcesIdempotent(instance) {
+				return nil
+			}
+		} else if announcesIdempotent(instance) {
+			others = append(others, instance)
+		}
+	}
+	return
+}
+
+// sendToFirstAvailable sends msg to the first instance in ordered that can be dialed and
+// accepts the message. ident names the instance used, or the last one that failed.
+// Dial and send failures are recorded against each instance in breakers.
+func sendToFirstAvailable(ordered []*serviceProxy, msg *Message, breakers *BreakerRegistry) (client *Client, responseChan chan *Message, ident string, err error) {
+	err = fmt.Errorf("no usable instances")
+
+	for _, serviceProxy := range ordered {
+		if serviceProxy == nil {
+			continue
+		}
+		ident = serviceProxy.Ident()
+		breakers.begin(ident)
+
+		var clientErr error
+		client, clientErr = serviceProxy.GetClient()
+		if clientErr != nil {
+			Error.Printf("GetClient failed for %s (%s): %s", serviceProxy.Ident(), serviceProxy.ConnSpec(), clientErr)
+			err = clientErr
+			breakers.record(ident, clientErr)
+			continue
+		}
+		if client == nil {
+			Error.Printf("GetClient returned nil client for %s (%s)", serviceProxy.Ident(), serviceProxy.ConnSpec())
+			breakers.record(ident, fmt.Errorf("nil client"))
+			continue
+		}
+
+		responseChan, err = client.Send(msg)
+		if err == nil {
 			return
 		}
+		breakers.record(ident, err)
 	}
 
-	if message == nil {
-		err = fmt.Errorf("no response was found")
+	client = nil
+	return
+}
+
+// triedLast moves instances that already failed this request to the back of ordered,
+// keeping them as a last resort
+func triedLast(ordered []*serviceProxy, tried map[string]bool) []*serviceProxy {
+	if len(tried) == 0 {
+		return ordered
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !tried[ordered[i].Ident()] && tried[ordered[j].Ident()]
+	})
+	return ordered
+}
+
+// waitForReply blocks until the reply for requestID arrives on responseChan or ctx is done.
+// On cancellation the reply slot is removed from client.openReplies. An error reply is
+// returned along with the error it carries.
+func waitForReply(ctx context.Context, client *Client, requestID int, responseChan chan *Message) (message *Message, err error) {
+	if responseChan == nil {
+		err = fmt.Errorf("response channel is nil")
 		return
 	}
 
-	return
+	select {
+	case respMsg, ok := <-responseChan:
+		if !ok || respMsg == nil {
+			// the client closed the channel: the connection went away before replying
+			err = &TransportError{Ident: client.ident(), Sent: true, Err: errNoResponse}
+			return
+		}
+
+		message = respMsg
+		err = respMsg.Err()
+		return
+	case <-ctx.Done():
+		client.cancelReply(requestID)
+		err = ctx.Err()
+		return
+	}
+}
+
+var errNoResponse = errors.New("no response was found")
+
+// isRetryable reports whether a failed request may be sent again: either nothing went out,
+// the connection failed before a reply came back, or a draining instance turned it away
+func isRetryable(err error) bool {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) && remoteErr.Code == ErrorCodeUnavailable {
+		return true
+	}
+	return errors.Is(err, ErrTransport)
 }
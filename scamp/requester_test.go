@@ -1,5 +1,16 @@
 package scamp
 
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
 // func TestRequester(t *testing.T) {
 // 	var err error
 
@@ -21,3 +32,393 @@ package scamp
 // 	Initialize("/etc/SCAMP/soa.conf")
 // 	os.Exit(m.Run())
 // }
+
+func TestWaitForReplyCancelled(t *testing.T) {
+	client := &Client{openReplies: make(map[int]chan *Message)}
+	responseChan := make(chan *Message, 1)
+	client.openReplies[7] = responseChan
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := waitForReply(ctx, client, 7, responseChan)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got `%v`", err)
+	}
+	if _, ok := client.openReplies[7]; ok {
+		t.Fatalf("reply slot was not removed after cancellation")
+	}
+}
+
+func TestWaitForReplyDelivers(t *testing.T) {
+	client := &Client{openReplies: make(map[int]chan *Message)}
+	responseChan := make(chan *Message, 1)
+	responseChan <- NewResponseMessage()
+
+	msg, err := waitForReply(context.Background(), client, 1, responseChan)
+	if err != nil || msg == nil {
+		t.Fatalf("expected reply, got `%v`", err)
+	}
+
+	close(responseChan)
+	_, err = waitForReply(context.Background(), client, 1, responseChan)
+	if err == nil {
+		t.Fatalf("expected error on closed response channel")
+	}
+}
+
+func TestSplitSectorAction(t *testing.T) {
+	sector, action := splitSectorAction("background:Foo.bar", "main")
+	if sector != "background" || action != "Foo.bar" {
+		t.Errorf("got %s %s", sector, action)
+	}
+
+	sector, action = splitSectorAction("Foo.bar", "")
+	if sector != "main" || action != "Foo.bar" {
+		t.Errorf("got %s %s", sector, action)
+	}
+}
+
+func TestDeliverReplyAbandoned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		// nobody ever reads replies
+		deliverReply(ctx, NewResponseMessage(), nil, make(chan *Message), make(chan error))
+		done <- true
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("deliverReply did not give up after cancellation")
+	}
+}
+
+func TestChannelRequestGivesUpOnDroppedReceiver(t *testing.T) {
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction("Nothing.here")
+
+	requester := NewScampRequesterWithCache(NewCacheRefresher(NewMemoryServiceCache(), RefresherOptions{}))
+	replies := make(chan *Message)
+	errs := make(chan error)
+	requester.MakeChannelJSONRequest(context.Background(), msg, 1, false, replies, errs)
+
+	// nobody reads until the timeout and grace period are over, by which point the
+	// result must have been given up on
+	time.Sleep(time.Second + replyDeliveryGrace + 200*time.Millisecond)
+	select {
+	case <-replies:
+		t.Errorf("the reply should have been abandoned")
+	case <-errs:
+		t.Errorf("the error should have been abandoned")
+	default:
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+
+	expected := []time.Duration{10, 20, 30, 30}
+	for i, wait := range expected {
+		got := policy.backoff(i + 2)
+		if got != wait*time.Millisecond {
+			t.Errorf("attempt %d: expected %s, got %s", i+2, wait*time.Millisecond, got)
+		}
+	}
+}
+
+func TestDoLimit(t *testing.T) {
+	calls := 0
+	err := DoLimit(3, func(attempt int) (bool, error) {
+		calls++
+		return true, errNoResponse
+	})
+	if !IsMaxRetries(err) || calls != 3 {
+		t.Errorf("expected 3 calls and max retries, got %d calls and `%v`", calls, err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if !isRetryable(&TransportError{Sent: true, Err: errNoResponse}) || !isRetryable(&TransportError{Err: errNoResponse}) {
+		t.Errorf("lost replies and send failures should be retryable")
+	}
+	if isRetryable(context.DeadlineExceeded) || isRetryable(NewRemoteError("general", "nope")) {
+		t.Errorf("timeouts and error replies should not be retried")
+	}
+}
+
+// newTestClientPair connects two Clients over an in-memory TLS connection using the
+// fixture keypair. The first is the requesting side, the second the serving side.
+func newTestClientPair(t *testing.T) (requester *Client, server *Client) {
+	initSCAMPLogger()
+
+	cert, err := tls.LoadX509KeyPair("../fixtures/sample.crt", "../fixtures/sample.key")
+	if err != nil {
+		t.Fatalf("could not load fixture keypair: `%s`", err)
+	}
+
+	clientSide, serverSide := net.Pipe()
+	serverConn := tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{cert}})
+	clientConn := tls.Client(clientSide, &tls.Config{InsecureSkipVerify: true})
+
+	handshakeErr := make(chan error, 1)
+	go func() {
+		handshakeErr <- serverConn.Handshake()
+	}()
+	err = clientConn.Handshake()
+	if err != nil {
+		t.Fatalf("client handshake failed: `%s`", err)
+	}
+	err = <-handshakeErr
+	if err != nil {
+		t.Fatalf("server handshake failed: `%s`", err)
+	}
+
+	requester = NewClient(NewConnection(clientConn, "client"), "test")
+	server = NewClient(NewConnection(serverConn, "service"), "test")
+	return
+}
+
+// testProxyFor wraps an already connected client in a serviceProxy
+func testProxyFor(ident string, client *Client) *serviceProxy {
+	client.spIdent = ident
+	return &serviceProxy{ident: ident, weight: 1, connspec: "beepish+tls://127.0.0.1:1", client: client}
+}
+
+func replyFrom(t *testing.T, server *Client, body string) {
+	go func() {
+		for request := range server.Incoming() {
+			reply := NewResponseMessage()
+			reply.SetRequestID(request.RequestID)
+			reply.Write([]byte(body))
+			server.Send(reply)
+		}
+	}()
+}
+
+func TestHedgeFirstReplyWins(t *testing.T) {
+	slowRequester, slowServer := newTestClientPair(t)
+	fastRequester, fastServer := newTestClientPair(t)
+	defer slowRequester.Close()
+	defer fastRequester.Close()
+	defer slowServer.Close()
+	defer fastServer.Close()
+
+	go func() {
+		// swallow requests without answering
+		for range slowServer.Incoming() {
+		}
+	}()
+	replyFrom(t, fastServer, "fast")
+
+	breakers := NewBreakerRegistry(DefaultBreakerOptions())
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction("Foo.bar")
+
+	ordered := []*serviceProxy{testProxyFor("slow", slowRequester), testProxyFor("fast", fastRequester)}
+	client, responseChan, ident, err := sendToFirstAvailable(ordered, msg, breakers)
+	if err != nil || ident != "slow" {
+		t.Fatalf("expected to send to the slow instance first, got %s `%v`", ident, err)
+	}
+	primary := inflightRequest{client: client, requestID: msg.RequestID, replies: responseChan, ident: ident}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	reply, ident, err := hedge(ctx, primary, withoutIdent(ordered, "slow"), 10*time.Millisecond, msg, breakers)
+	if err != nil {
+		t.Fatalf("hedged request failed: `%s`", err)
+	}
+	if ident != "fast" || string(reply.Bytes()) != "fast" {
+		t.Fatalf("expected the fast instance to win, got %s `%s`", ident, reply.Bytes())
+	}
+
+	// the slow instance's reply slot is released once hedge returns
+	deadline := time.Now().Add(time.Second)
+	for slowRequester.outstanding() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("loser's reply slot was not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newSilentRequester returns a requester whose only Logging.info instance accepts
+// requests and never answers them
+func newSilentRequester(t *testing.T) *ScampRequester {
+	requester, server := newTestClientPair(t)
+	t.Cleanup(requester.Close)
+	t.Cleanup(server.Close)
+	go func() {
+		for range server.Incoming() {
+		}
+	}()
+
+	cache := NewMemoryServiceCache()
+	cache.Store(announcedInstance(t, "announced-1234", requester))
+	return NewScampRequesterWithCache(NewCacheRefresher(cache, RefresherOptions{}))
+}
+
+// announcedInstance is the instance described by a test service's announcement (it
+// offers Logging.info), reached through client
+func announcedInstance(t *testing.T, ident string, client *Client) *serviceProxy {
+	serv := newAnnouncedTestService(t)
+	serv.name = ident
+	instance, err := parseAnnouncement(announcementOf(t, serv))
+	if err != nil {
+		t.Fatalf("parse announcement: %s", err)
+	}
+	client.spIdent = ident
+	instance.client = client
+	return instance
+}
+
+// identOrder tries instances in the order of their idents
+type identOrder struct{}
+
+func (identOrder) Order(candidates []Candidate) []Candidate {
+	ordered := append([]Candidate(nil), candidates...)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].Ident() < ordered[j].Ident()
+	})
+	return ordered
+}
+
+func TestRequesterFailsOverToAnotherInstance(t *testing.T) {
+	brokenRequester, brokenServer := newTestClientPair(t)
+	workingRequester, workingServer := newTestClientPair(t)
+	defer workingRequester.Close()
+	defer workingServer.Close()
+
+	// the first instance drops the connection as soon as a request arrives
+	var brokenCalls int32
+	go func() {
+		for range brokenServer.Incoming() {
+			atomic.AddInt32(&brokenCalls, 1)
+			brokenServer.Close()
+		}
+	}()
+	replyFrom(t, workingServer, "working")
+
+	cache := NewMemoryServiceCache()
+	cache.Store(announcedInstance(t, "a-broken", brokenRequester))
+	cache.Store(announcedInstance(t, "b-working", workingRequester))
+	requester := NewScampRequesterWithCache(NewCacheRefresher(cache, RefresherOptions{}))
+	requester.Balancer = identOrder{}
+
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction("Logging.info")
+	reply, err := requester.MakeJSONRequest(context.Background(), msg, 2, true)
+	if err != nil {
+		t.Fatalf("expected the request to fail over: %s", err)
+	}
+	if string(reply.Bytes()) != "working" || atomic.LoadInt32(&brokenCalls) != 1 {
+		t.Errorf("expected one attempt on the broken instance and a reply from the working one, got %d and `%s`",
+			brokenCalls, reply.Bytes())
+	}
+}
+
+func TestRequestLookupErrors(t *testing.T) {
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction("Nothing.here")
+
+	requester := NewScampRequesterWithCache(NewCacheRefresher(NewMemoryServiceCache(), RefresherOptions{}))
+	_, err := requester.MakeJSONRequest(context.Background(), msg, 1, false)
+	var noInstances *NoInstancesError
+	if !errors.As(err, &noInstances) || noInstances.Action != "Nothing.here" {
+		t.Errorf("expected NoInstancesError for an action nobody offers, got %v", err)
+	}
+
+	defaultCache := DefaultCache
+	DefaultCache = nil
+	defer func() { DefaultCache = defaultCache }()
+
+	_, err = NewScampRequester().MakeJSONRequest(context.Background(), msg, 1, false)
+	if err == nil || errors.Is(err, ErrNoInstances) {
+		t.Errorf("a missing cache is not a lack of instances, got %v", err)
+	}
+}
+
+// hedgedRequestCopies sends one hedged request to two instances that never answer and
+// counts the copies they receive. crudTags is what the instances announce for the action.
+func hedgedRequestCopies(t *testing.T, crudTags string) int32 {
+	cache := NewMemoryServiceCache()
+	var copies int32
+	for _, ident := range []string{"a-silent", "b-silent"} {
+		requester, server := newTestClientPair(t)
+		t.Cleanup(requester.Close)
+		t.Cleanup(server.Close)
+		go func() {
+			for range server.Incoming() {
+				atomic.AddInt32(&copies, 1)
+			}
+		}()
+
+		instance := announcedInstance(t, ident, requester)
+		instance.classes[0].actions[0].crudTags = crudTags
+		cache.Store(instance)
+	}
+	requester := NewScampRequesterWithCache(NewCacheRefresher(cache, RefresherOptions{}))
+
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction("Logging.info")
+	_, err := requester.MakeJSONRequestWithOptions(context.Background(), msg, RequestOptions{
+		Timeout:    300 * time.Millisecond,
+		Idempotent: true,
+		HedgeDelay: 10 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+	// let a late copy arrive
+	time.Sleep(50 * time.Millisecond)
+	return atomic.LoadInt32(&copies)
+}
+
+func TestHedgingNeedsAnIdempotentAction(t *testing.T) {
+	if copies := hedgedRequestCopies(t, ""); copies != 1 {
+		t.Errorf("an action not announced as idempotent was sent %d times", copies)
+	}
+	if copies := hedgedRequestCopies(t, CrudRead); copies != 2 {
+		t.Errorf("expected a read action to be hedged, got %d copies", copies)
+	}
+	if copies := hedgedRequestCopies(t, FlagIdempotent); copies != 2 {
+		t.Errorf("expected an idempotent action to be hedged, got %d copies", copies)
+	}
+}
+
+func TestChannelRequestsDeliverTimeouts(t *testing.T) {
+	requester := newSilentRequester(t)
+
+	// unbuffered, and nobody is reading when the requests time out
+	replies := make(chan *Message)
+	errs := make(chan error)
+	const requests = 5
+	for i := 0; i < requests; i++ {
+		msg := NewRequestMessage()
+		msg.SetEnvelope(EnvelopeJSON)
+		msg.SetAction("Logging.info")
+		requester.MakeChannelJSONRequest(context.Background(), msg, 1, false, replies, errs)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	for i := 0; i < requests; i++ {
+		select {
+		case <-replies:
+			t.Fatalf("a silent instance should not produce replies")
+		case err := <-errs:
+			if !errors.Is(err, ErrTimeout) {
+				t.Errorf("expected a timeout, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d results were delivered", i, requests)
+		}
+	}
+}
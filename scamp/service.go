@@ -2,15 +2,20 @@ package scamp
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +25,10 @@ import (
 // Two minute timeout on clients
 var msgTimeout = time.Second * 120
 
+// DefaultConnectionConcurrency is how many requests from one connection a service
+// handles at the same time unless SetConnectionConcurrency says otherwise
+const DefaultConnectionConcurrency = 16
+
 // ServiceActionFunc represents a service callback
 type ServiceActionFunc interface {
 	Call(*Message, *Client)
@@ -33,9 +42,21 @@ func (function BasicActionFunc) Call(message *Message, client *Client) {
 
 // ServiceAction interface
 type ServiceAction struct {
+	name     string
 	callback ServiceActionFunc
 	crudTags string
 	version  int
+	// envelopes the action accepts, if not just the service's
+	envelopes []string
+	// sector the action is announced in, if not the service's
+	sector string
+
+	// handler is callback wrapped in the service middleware, built on first use
+	handler ServiceActionFunc
+	// slots bounds concurrent calls of this action; nil means unlimited
+	slots chan struct{}
+	// panics counts handler invocations that panicked
+	panics uint64
 }
 
 // Service represents a scamp service
@@ -49,13 +70,41 @@ type Service struct {
 	listenerIP   net.IP
 	listenerPort int
 
+	actionsM  sync.Mutex
 	actions   map[string]*ServiceAction
 	isRunning bool
 
+	middleware       []Middleware
+	middlewareSealed bool
+
+	// concurrency limits; serviceSlots is nil when the service has no overall limit
+	connectionConcurrency int
+	serviceSlots          chan struct{}
+
 	clientsM sync.Mutex
 	clients  []*Client
 	cert     tls.Certificate
 	pemCert  []byte // just a copy of what was read off disk at tls cert load time
+	// clientAuth is the client certificate policy for incoming connections
+	clientAuth tls.ClientAuthType
+
+	// shutdown; draining is set once Shutdown starts and guarded by drainM so no
+	// request is added to inflight after Shutdown begins waiting on it
+	drainM       sync.Mutex
+	draining     bool
+	inflight     sync.WaitGroup
+	teardownOnce sync.Once
+	shutdownDone chan struct{}
+
+	// announcer is the DiscoveryAnnouncer tracking the service, if any
+	announcerM sync.Mutex
+	announcer  *DiscoveryAnnouncer
+
+	// announcement settings; zero values mean the defaults
+	announceM        sync.Mutex
+	weight           int
+	weightSet        bool
+	announceInterval time.Duration
 
 	// stats
 	statsCloseChan      chan bool
@@ -104,6 +153,7 @@ func NewServiceExplicitCert(sector string, serviceSpec string, humanName string,
 	serv.humanName = humanName
 	serv.generateRandomName()
 	serv.actions = make(map[string]*ServiceAction)
+	serv.connectionConcurrency = DefaultConnectionConcurrency
 	serv.cert = keypair
 	serv.pemCert = bytes.TrimSpace(pemCert)
 
@@ -113,6 +163,7 @@ func NewServiceExplicitCert(sector string, serviceSpec string, humanName string,
 	}
 
 	serv.statsCloseChan = make(chan bool)
+	serv.shutdownDone = make(chan struct{})
 	return
 }
 
@@ -120,7 +171,8 @@ func NewServiceExplicitCert(sector string, serviceSpec string, humanName string,
 // important to set values so announce packets are correct
 func (serv *Service) listen() (err error) {
 	config := &tls.Config{
-		Certificates: []tls.Certificate{serv.cert},
+		Certificates:       []tls.Certificate{serv.cert},
+		GetConfigForClient: serv.tlsConfigForClient,
 	}
 
 	Info.Printf("starting service on %s", serv.serviceSpec)
@@ -144,10 +196,24 @@ func (serv *Service) listen() (err error) {
 	return
 }
 
-// Register registers a service handler callback
+// running reports whether the service has started, after which its handlers and limits
+// are fixed
+func (serv *Service) running() bool {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+	return serv.isRunning
+}
+
+// actionKey is how actions are keyed in Service.actions: one entry per name and version
+func actionKey(name string, version int) string {
+	return fmt.Sprintf("%s~%d", name, version)
+}
+
+// Register registers a service handler callback. Several versions of one action can be
+// registered side by side by setting ActionOptions.Version.
 func (serv *Service) Register(name string, callback func(*Message, *Client), options *ActionOptions) (err error) {
-	if serv.isRunning {
-		err = errors.New("cannot register handlers while server is running")
+	if !strings.Contains(name, ".") {
+		err = fmt.Errorf("bad action name: `%s` (expected Class.action)", name)
 		return
 	}
 
@@ -156,18 +222,96 @@ func (serv *Service) Register(name string, callback func(*Message, *Client), opt
 		actionOptions = *options
 	}
 
-	serv.actions[name] = &ServiceAction{
-		callback: ServiceOptionsFunc{
-			callback: BasicActionFunc(callback),
-			options:  actionOptions,
-		},
-		version: 1,
+	version := actionOptions.Version
+	if version == 0 {
+		version = 1
+	}
+
+	crudTags, err := actionOptions.tags()
+	if err != nil {
+		return
+	}
+
+	sector := actionOptions.Sector
+	if sector == serv.sector {
+		sector = ""
+	}
+
+	actionMiddleware := append([]Middleware{VerifyTicketMiddleware(actionOptions)}, actionOptions.Middleware...)
+
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	if serv.isRunning {
+		err = errors.New("cannot register handlers while server is running")
+		return
+	}
+
+	key := actionKey(name, version)
+	if existing, ok := serv.actions[key]; ok {
+		err = fmt.Errorf("action `%s` version %d is already registered", name, version)
+		if existing.sector != sector {
+			err = fmt.Errorf("action `%s` version %d is already registered in another sector", name, version)
+		}
+		return
+	}
+
+	action := &ServiceAction{
+		name:      name,
+		callback:  chainMiddleware(BasicActionFunc(callback), actionMiddleware),
+		crudTags:  crudTags,
+		version:   version,
+		envelopes: actionOptions.Envelopes,
+		sector:    sector,
+	}
+	if actionOptions.MaxConcurrency > 0 {
+		action.slots = make(chan struct{}, actionOptions.MaxConcurrency)
+	}
+
+	serv.actions[key] = action
+	return
+}
+
+// lookupAction finds the handler for msg's action and version. A nil action with a
+// nil err means no version of the action is registered at all.
+func (serv *Service) lookupAction(msg *Message) (action *ServiceAction, err error) {
+	version := msg.Version
+	if version == 0 {
+		version = 1
+	}
+
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	action = serv.actions[actionKey(msg.Action, version)]
+	if action != nil {
+		return
+	}
+
+	var versions []int
+	for _, candidate := range serv.actions {
+		if candidate.name == msg.Action {
+			versions = append(versions, candidate.version)
+		}
+	}
+	if len(versions) > 0 {
+		sort.Ints(versions)
+		registered := make([]string, len(versions))
+		for i, registeredVersion := range versions {
+			registered[i] = strconv.Itoa(registeredVersion)
+		}
+		err = NewRemoteError(ErrorCodeUnknownVersion, fmt.Sprintf("no version %d of `%s` (registered: %s)", version, msg.Action, strings.Join(registered, ", ")))
 	}
 	return
 }
 
-// Run starts a scamp service
+// Run starts a scamp service. Handlers, middleware and concurrency limits can no longer
+// be changed once it has been called.
 func (serv *Service) Run() {
+	serv.actionsM.Lock()
+	serv.isRunning = true
+	serv.actionsM.Unlock()
+
 	err := serv.createRunningServiceFile()
 	if err != nil {
 		fmt.Println(err)
@@ -186,36 +330,321 @@ forLoop:
 			break forLoop
 		}
 
-		conn := NewConnection(tlsConn, "service")
-		client := NewClient(conn, "service")
+		go serv.accept(tlsConn)
+
+		atomic.AddUint64(&serv.connectionsAccepted, 1)
+	}
+
+	// Shutdown closed the listener and owns the rest of the teardown
+	if serv.isDraining() {
+		<-serv.shutdownDone
+		return
+	}
+
+	serv.teardown()
+}
 
+// Shutdown gracefully stops the service. It stops accepting connections and stops
+// being announced, then waits for in-flight requests to finish and send their replies.
+// Requests that arrive on open connections in the meantime are answered with an
+// ErrorCodeUnavailable error. Once everything has drained, or ctx is done, connections
+// are closed and the running-service file is removed. Shutdown returns ctx.Err() if
+// requests were still in flight when ctx ended.
+func (serv *Service) Shutdown(ctx context.Context) (err error) {
+	serv.drainM.Lock()
+	alreadyDraining := serv.draining
+	serv.draining = true
+	serv.drainM.Unlock()
+
+	if alreadyDraining {
+		select {
+		case <-serv.shutdownDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		return
+	}
+
+	Info.Printf("shutting down %s, draining in-flight requests", serv.name)
+
+	// let discovery caches drop us before the listener goes away
+	serv.announcerM.Lock()
+	announcer := serv.announcer
+	serv.announcerM.Unlock()
+	if announcer != nil {
+		announcer.Untrack(serv)
+	}
+
+	if serv.listener != nil {
+		serv.listener.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		serv.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		Error.Printf("shutdown of %s gave up waiting for in-flight requests: %s", serv.name, err)
+	}
+
+	serv.teardown()
+	if serv.shutdownDone != nil {
+		close(serv.shutdownDone)
+	}
+	return
+}
+
+// isDraining reports whether Shutdown has been called
+func (serv *Service) isDraining() bool {
+	serv.drainM.Lock()
+	defer serv.drainM.Unlock()
+	return serv.draining
+}
+
+// beginRequest registers a request as in flight. It returns false once the service is
+// draining, in which case the request must not be handled.
+func (serv *Service) beginRequest() bool {
+	serv.drainM.Lock()
+	defer serv.drainM.Unlock()
+
+	if serv.draining {
+		return false
+	}
+	serv.inflight.Add(1)
+	return true
+}
+
+// teardown closes every connection and removes the running-service file. It only
+// runs once, whether reached through Run or Shutdown.
+func (serv *Service) teardown() {
+	serv.teardownOnce.Do(func() {
 		serv.clientsM.Lock()
-		serv.clients = append(serv.clients, client)
+		clients := make([]*Client, len(serv.clients))
+		copy(clients, serv.clients)
 		serv.clientsM.Unlock()
 
-		go serv.Handle(client)
+		for _, client := range clients {
+			client.Close()
+		}
 
-		atomic.AddUint64(&serv.connectionsAccepted, 1)
+		// nobody may be running PrintStatsLoop
+		select {
+		case serv.statsCloseChan <- true:
+		default:
+		}
+
+		err := serv.removeRunningServiceFile()
+		if err != nil {
+			fmt.Println("could not remove liveness file: ", err)
+		}
+		fmt.Println("shutdown done")
+	})
+}
+
+// acceptHandshakeTimeout bounds how long a new connection may take over its TLS handshake
+const acceptHandshakeTimeout = 10 * time.Second
+
+// accept completes the handshake of a new connection, so the caller's certificate is
+// known (see Client.Fingerprint), and then handles its requests
+func (serv *Service) accept(tlsConn *tls.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), acceptHandshakeTimeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		Error.Printf("handshake with %s failed: %s", tlsConn.RemoteAddr(), err)
+		tlsConn.Close()
+		return
 	}
 
+	conn := NewConnection(tlsConn, "service")
+	client := NewClient(conn, "service")
+
 	serv.clientsM.Lock()
-	for _, client := range serv.clients {
-		client.Close()
-	}
+	serv.clients = append(serv.clients, client)
 	serv.clientsM.Unlock()
 
-	serv.statsCloseChan <- true
+	serv.Handle(client)
+}
+
+// SetClientAuth sets whether callers must present a client certificate (see
+// DialOptions.Certificate and ServiceCache.SetClientCertificate). Service certificates
+// are self-signed, so use tls.RequestClientCert or tls.RequireAnyClientCert: a presented
+// certificate is checked against bus.authorized_services when that is configured, not
+// against a CA. Handlers see the caller's certificate as Client.Fingerprint.
+func (serv *Service) SetClientAuth(auth tls.ClientAuthType) (err error) {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	if serv.isRunning {
+		err = errors.New("cannot change client auth while server is running")
+		return
+	}
+
+	serv.clientAuth = auth
+	return
+}
+
+// Certificate returns the service's keypair, for presenting as a client certificate
+// (see ServiceCache.SetClientCertificate)
+func (serv *Service) Certificate() tls.Certificate {
+	return serv.cert
+}
+
+// tlsConfigForClient applies the client certificate policy to each handshake
+func (serv *Service) tlsConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	serv.actionsM.Lock()
+	clientAuth := serv.clientAuth
+	serv.actionsM.Unlock()
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{serv.cert},
+		ClientAuth:   clientAuth,
+	}
+	if clientAuth != tls.NoClientCert {
+		config.VerifyPeerCertificate = verifyClientCertificate
+	}
+	return config, nil
+}
+
+// verifyClientCertificate accepts a caller whose certificate is in authorized_services,
+// or any caller when authorized_services is not configured
+func verifyClientCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		// tls has already rejected the handshake if a certificate was required
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return &VerificationError{Err: fmt.Errorf("client certificate: %s", err)}
+	}
 
-	err = serv.removeRunningServiceFile()
+	authorized, err := defaultAuthorizedServices()
 	if err != nil {
-		fmt.Println("could not remove liveness file: ", err)
+		return &VerificationError{Err: err}
+	} else if authorized == nil {
+		return nil
+	}
+
+	fingerprint := sha1FingerPrint(cert)
+	if authorized.Lookup(fingerprint) == nil {
+		return &VerificationError{Err: fmt.Errorf("client certificate %s is not in authorized_services", fingerprint)}
 	}
-	fmt.Println("shutdown done")
+	return nil
 }
 
-// Handle handles incoming client messages received via the cient MessageChan
+// SetConnectionConcurrency sets how many requests from a single connection are handled
+// at once. Further requests on that connection wait until a handler finishes; requests
+// waiting on an action's MaxConcurrency count against the limit too, so the connection
+// stops being read while they wait. A limit of 1 handles each connection's requests one
+// at a time, in order.
+func (serv *Service) SetConnectionConcurrency(limit int) (err error) {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	if serv.isRunning {
+		err = errors.New("cannot change concurrency while server is running")
+		return
+	}
+	if limit < 1 {
+		err = fmt.Errorf("concurrency limit must be at least 1, got %d", limit)
+		return
+	}
+
+	serv.connectionConcurrency = limit
+	return
+}
+
+// SetMaxConcurrency limits how many requests the service handles at once across all of
+// its connections. Zero removes the limit.
+func (serv *Service) SetMaxConcurrency(limit int) (err error) {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	if serv.isRunning {
+		err = errors.New("cannot change concurrency while server is running")
+		return
+	}
+	if limit < 0 {
+		err = fmt.Errorf("concurrency limit must not be negative, got %d", limit)
+		return
+	}
+
+	serv.serviceSlots = nil
+	if limit > 0 {
+		serv.serviceSlots = make(chan struct{}, limit)
+	}
+	return
+}
+
+// SetWeight sets the weight announced for this instance. Requesters send proportionally
+// more traffic to heavier instances. A weight of zero is not a low priority: it drains
+// the instance, since discovery caches drop zero-weight announcements the way they drop
+// going-away ones. Takes effect at the next announcement.
+func (serv *Service) SetWeight(weight int) (err error) {
+	if weight < 0 {
+		err = fmt.Errorf("weight must not be negative, got %d", weight)
+		return
+	}
+
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+	serv.weight = weight
+	serv.weightSet = true
+	return
+}
+
+// Weight returns the weight announced for this instance (1 unless SetWeight was called)
+func (serv *Service) Weight() int {
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+
+	if !serv.weightSet {
+		return 1
+	}
+	return serv.weight
+}
+
+// SetAnnounceInterval sets how often DiscoveryAnnouncer announces this service. The
+// interval is also advertised, so discovery caches know when the instance has gone quiet.
+func (serv *Service) SetAnnounceInterval(interval time.Duration) (err error) {
+	if interval < time.Millisecond {
+		err = fmt.Errorf("announce interval must be at least 1ms, got %s", interval)
+		return
+	}
+
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+	serv.announceInterval = interval
+	return
+}
+
+// AnnounceInterval returns how often this service is announced
+func (serv *Service) AnnounceInterval() time.Duration {
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+
+	if serv.announceInterval <= 0 {
+		return time.Duration(defaultAnnounceInterval) * time.Second
+	}
+	return serv.announceInterval
+}
+
+// Handle handles incoming client messages received via the cient MessageChan.
+// Requests are handled concurrently, up to the connection, service and action limits;
+// each reply carries the RequestID of its request so it may be sent out of order.
 func (serv *Service) Handle(client *Client) {
-	var action *ServiceAction
+	connectionConcurrency := serv.connectionConcurrency
+	if connectionConcurrency < 1 {
+		connectionConcurrency = 1
+	}
+	connectionSlots := make(chan struct{}, connectionConcurrency)
+	var inflight sync.WaitGroup
+
 HandlerLoop:
 	for {
 		select {
@@ -231,33 +660,146 @@ HandlerLoop:
 				msg.ClientID,
 			)
 
-			action = serv.actions[msg.Action]
+			action, err := serv.lookupAction(msg)
+			if err != nil {
+				Error.Printf("cannot handle `%s`: %s", msg.Action, err)
 
-			if action != nil {
-				action.callback.Call(msg, client)
-			} else {
+				_, err = client.Send(NewErrorReply(msg, err))
+				if err != nil {
+					break HandlerLoop
+				}
+				continue
+			}
+
+			if action == nil {
 				Error.Printf("do not know how to handle action `%s`", msg.Action)
 
-				reply := NewMessage()
-				reply.SetMessageType(MessageTypeReply)
+				reply := NewErrorReply(msg, NewRemoteError(ErrorCodeNotFound, "no such action"))
 				reply.SetEnvelope(EnvelopeJSON)
-				reply.SetRequestID(msg.RequestID)
 				reply.Write([]byte(`{"error": "no such action"}`))
 				_, err := client.Send(reply)
 				if err != nil {
-					client.Close()
 					break HandlerLoop
 				}
+				continue
+			}
+
+			if !serv.beginRequest() {
+				reply := NewErrorReply(msg, NewRemoteError(ErrorCodeUnavailable, "service is shutting down"))
+				_, err := client.Send(reply)
+				if err != nil {
+					break HandlerLoop
+				}
+				continue
 			}
+
+			// stop reading from this connection while it is at its limit
+			slots := requestSlots{connection: connectionSlots, service: serv.serviceSlots}
+			slots.acquire()
+
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				defer serv.inflight.Done()
+				defer slots.release()
+
+				serv.dispatch(action, msg, client, slots)
+			}()
 		case <-time.After(msgTimeout):
 			break HandlerLoop
 		}
 	}
 
+	// let in-flight requests send their replies before the connection goes away
+	inflight.Wait()
+
 	client.Close()
 	serv.RemoveClient(client)
 }
 
+// requestSlots are the connection and service wide slots a request holds while it is
+// handled; service is nil when the service has no overall limit
+type requestSlots struct {
+	connection chan struct{}
+	service    chan struct{}
+}
+
+func (slots requestSlots) acquire() {
+	slots.connection <- struct{}{}
+	if slots.service != nil {
+		slots.service <- struct{}{}
+	}
+}
+
+func (slots requestSlots) release() {
+	slots.releaseService()
+	<-slots.connection
+}
+
+func (slots requestSlots) acquireService() {
+	if slots.service != nil {
+		slots.service <- struct{}{}
+	}
+}
+
+func (slots requestSlots) releaseService() {
+	if slots.service != nil {
+		<-slots.service
+	}
+}
+
+// dispatch calls the handler for one request, waiting for a free slot if the action
+// has a concurrency limit. The service slot is given back while it waits, so a saturated
+// action doesn't hold up other connections' requests. The connection slot is kept: the
+// connection's requests stay in order and a connection flooding a saturated action stops
+// being read. A panicking handler is answered with an ErrorCodeInternal reply instead of
+// taking the service down.
+func (serv *Service) dispatch(action *ServiceAction, msg *Message, client *Client, slots requestSlots) {
+	if action.slots != nil {
+		select {
+		case action.slots <- struct{}{}:
+		default:
+			slots.releaseService()
+			action.slots <- struct{}{}
+			slots.acquireService()
+		}
+		defer func() { <-action.slots }()
+	}
+
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		atomic.AddUint64(&action.panics, 1)
+		Error.Printf("`%s` (request %d, client %d): handler panicked: %v\n%s", msg.Action, msg.RequestID, msg.ClientID, recovered, debug.Stack())
+
+		reply := NewErrorReply(msg, NewRemoteError(ErrorCodeInternal, "internal error"))
+		_, err := client.Send(reply)
+		if err != nil {
+			Error.Printf("(messageID: %v, messageAction: %v) send error: %v\n", msg.RequestID, msg.Action, err)
+		}
+	}()
+
+	serv.handlerFor(action).Call(msg, client)
+}
+
+// PanicCounts returns how many times each action's handler has panicked, keyed by
+// `name~version`. Actions that never panicked are left out.
+func (serv *Service) PanicCounts() map[string]uint64 {
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
+	counts := make(map[string]uint64)
+	for name, action := range serv.actions {
+		if panics := atomic.LoadUint64(&action.panics); panics > 0 {
+			counts[name] = panics
+		}
+	}
+	return counts
+}
+
 // RemoveClient removes a client from the scamp service
 func (serv *Service) RemoveClient(client *Client) (err error) {
 	serv.clientsM.Lock()
@@ -282,7 +824,8 @@ func (serv *Service) RemoveClient(client *Client) (err error) {
 	return nil
 }
 
-// Stop closes the service's net.Listener
+// Stop closes the service's net.Listener. Requests in progress are cut off; use
+// Shutdown to let them finish.
 func (serv *Service) Stop() {
 	if serv.listener != nil {
 		serv.listener.Close()
@@ -292,9 +835,22 @@ func (serv *Service) Stop() {
 
 // MarshalText serializes a scamp service
 func (serv *Service) MarshalText() (b []byte, err error) {
+	return serv.marshalAnnouncement(false)
+}
+
+// marshalAnnouncement serializes the service for discovery. A goingAway announcement
+// carries a weight of zero, which tells discovery caches to drop the instance.
+func (serv *Service) marshalAnnouncement(goingAway bool) (b []byte, err error) {
 	var buf bytes.Buffer
 
 	serviceProxy := serviceAsServiceProxy(serv)
+	if serviceProxy == nil {
+		err = errors.New("could not describe service for announcement")
+		return
+	}
+	if goingAway {
+		serviceProxy.weight = 0
+	}
 
 	classRecord, err := serviceProxy.MarshalJSON() // json.Marshal(&serviceProxy) //Marshal is mangling service actions
 	if err != nil {
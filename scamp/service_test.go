@@ -1,5 +1,7 @@
 package scamp
 
+import "context"
+import "fmt"
 import "testing"
 import "time"
 import "bytes"
@@ -7,6 +9,8 @@ import "encoding/json"
 import "net"
 import "crypto/tls"
 import "io/ioutil"
+import "strings"
+import "sync/atomic"
 
 // TODO: fix Session API (aka, simplify design by dropping it)
 func TestServiceHandlesRequest(t *testing.T) {
@@ -103,7 +107,7 @@ func TestServiceToProxyMarshal(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not serialize service proxy")
 	}
-	expected := []byte(`[3,"a-cool-name-1234","main",1,2500,"beepish+tls://174.10.10.10:30100",["json"],[["Logging",["info","",1]]],10.000000]`)
+	expected := []byte(`[3,"a-cool-name-1234","main",1,5000,"beepish+tls://174.10.10.10:30100",["json"],[["Logging",["info","",1]]],10.000000]`)
 	if !bytes.Equal(b, expected) {
 		t.Fatalf("expected: `%s`,\n\tgot:\t`%s`\n", expected, b)
 	}
@@ -147,3 +151,384 @@ func TestFullServiceMarshal(t *testing.T) {
 	// t.Fatalf("b: `%s`", b)
 
 }
+
+func newTestService() *Service {
+	return &Service{
+		actions:               make(map[string]*ServiceAction),
+		connectionConcurrency: DefaultConnectionConcurrency,
+	}
+}
+
+func sendTestRequest(t *testing.T, client *Client, action string) (int, chan *Message) {
+	msg := NewRequestMessage()
+	msg.SetAction(action)
+	msg.SetEnvelope(EnvelopeJSON)
+	responseChan, err := client.Send(msg)
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	return msg.RequestID, responseChan
+}
+
+func TestServiceHandlesConnectionConcurrently(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	release := make(chan bool)
+	serv := newTestService()
+	reply := func(message *Message, client *Client) {
+		reply := NewResponseMessage()
+		reply.SetRequestID(message.RequestID)
+		reply.Write([]byte(message.Action))
+		client.Send(reply)
+	}
+	serv.Register("Test.slow", func(message *Message, client *Client) {
+		<-release
+		reply(message, client)
+	}, nil)
+	serv.Register("Test.fast", reply, nil)
+	go serv.Handle(server)
+
+	slowID, slowReplies := sendTestRequest(t, requester, "Test.slow")
+	fastID, fastReplies := sendTestRequest(t, requester, "Test.fast")
+
+	select {
+	case msg := <-fastReplies:
+		if msg.RequestID != fastID || string(msg.Bytes()) != "Test.fast" {
+			t.Errorf("fast reply was mismatched: %d %s", msg.RequestID, msg.Bytes())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("fast request was blocked behind the slow one")
+	}
+
+	close(release)
+	select {
+	case msg := <-slowReplies:
+		if msg.RequestID != slowID || string(msg.Bytes()) != "Test.slow" {
+			t.Errorf("slow reply was mismatched: %d %s", msg.RequestID, msg.Bytes())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no reply for the slow request")
+	}
+}
+
+func TestServiceActionConcurrencyLimit(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	var running, peak int32
+	serv := newTestService()
+	serv.Register("Test.limited", func(message *Message, client *Client) {
+		now := atomic.AddInt32(&running, 1)
+		if now > atomic.LoadInt32(&peak) {
+			atomic.StoreInt32(&peak, now)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+
+		reply := NewResponseMessage()
+		reply.SetRequestID(message.RequestID)
+		client.Send(reply)
+	}, &ActionOptions{MaxConcurrency: 1})
+	go serv.Handle(server)
+
+	var replies []chan *Message
+	for i := 0; i < 3; i++ {
+		_, responseChan := sendTestRequest(t, requester, "Test.limited")
+		replies = append(replies, responseChan)
+	}
+	for _, responseChan := range replies {
+		select {
+		case <-responseChan:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for reply")
+		}
+	}
+
+	if atomic.LoadInt32(&peak) != 1 {
+		t.Errorf("expected at most 1 concurrent call, saw %d", peak)
+	}
+}
+
+func TestServiceSaturatedActionDoesNotBlockOthers(t *testing.T) {
+	flooder, flooderServer := newTestClientPair(t)
+	defer flooder.Close()
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	release := make(chan bool)
+	defer close(release)
+
+	serv := newTestService()
+	serv.SetConnectionConcurrency(2)
+	serv.SetMaxConcurrency(2)
+	serv.Register("Test.limited", func(message *Message, client *Client) {
+		<-release
+	}, &ActionOptions{MaxConcurrency: 1})
+	serv.Register("Test.other", func(message *Message, client *Client) {
+		reply := NewResponseMessage()
+		reply.SetRequestID(message.RequestID)
+		client.Send(reply)
+	}, nil)
+	go serv.Handle(flooderServer)
+	go serv.Handle(server)
+
+	// the first call runs and the next queues on the action's limit without keeping a
+	// service slot; the last waits for the flooding connection to free up
+	for i := 0; i < 3; i++ {
+		sendTestRequest(t, flooder, "Test.limited")
+	}
+	_, otherReplies := sendTestRequest(t, requester, "Test.other")
+	select {
+	case <-otherReplies:
+	case <-time.After(time.Second):
+		t.Fatalf("a saturated action starved a different one")
+	}
+}
+
+func TestServiceQueuedRequestKeepsConnectionOrder(t *testing.T) {
+	first, firstServer := newTestClientPair(t)
+	defer first.Close()
+	second, secondServer := newTestClientPair(t)
+	defer second.Close()
+
+	release := make(chan bool)
+	serv := newTestService()
+	serv.SetConnectionConcurrency(1)
+	reply := func(message *Message, client *Client) {
+		reply := NewResponseMessage()
+		reply.SetRequestID(message.RequestID)
+		reply.Write([]byte(message.Action))
+		client.Send(reply)
+	}
+	serv.Register("Test.limited", func(message *Message, client *Client) {
+		<-release
+		reply(message, client)
+	}, &ActionOptions{MaxConcurrency: 1})
+	serv.Register("Test.other", reply, nil)
+	go serv.Handle(firstServer)
+	go serv.Handle(secondServer)
+
+	_, firstReplies := sendTestRequest(t, first, "Test.limited")
+	time.Sleep(50 * time.Millisecond)
+
+	// the second connection's request queues on the action, and its next request must
+	// not overtake it
+	_, queuedReplies := sendTestRequest(t, second, "Test.limited")
+	_, otherReplies := sendTestRequest(t, second, "Test.other")
+	select {
+	case <-otherReplies:
+		t.Fatalf("a request overtook an earlier one on a connection with a limit of 1")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	for _, replies := range []chan *Message{firstReplies, queuedReplies, otherReplies} {
+		select {
+		case <-replies:
+		case <-time.After(time.Second):
+			t.Fatalf("requests were not handled once the action freed up")
+		}
+	}
+}
+
+func TestServiceSettersFailOnceRunning(t *testing.T) {
+	initSCAMPLogger()
+	serv := runTestService(t, func(*Service) {})
+
+	if err := serv.SetConnectionConcurrency(2); err == nil {
+		t.Errorf("SetConnectionConcurrency should fail once the service runs")
+	}
+	if err := serv.SetMaxConcurrency(2); err == nil {
+		t.Errorf("SetMaxConcurrency should fail once the service runs")
+	}
+	if err := serv.Register("Test.late", func(*Message, *Client) {}, nil); err == nil {
+		t.Errorf("Register should fail once the service runs")
+	}
+	if err := serv.Use(func(next ServiceActionFunc) ServiceActionFunc { return next }); err == nil {
+		t.Errorf("Use should fail once the service runs")
+	}
+	if err := serv.SetClientAuth(tls.RequireAnyClientCert); err == nil {
+		t.Errorf("SetClientAuth should fail once the service runs")
+	}
+}
+
+func TestServiceRecoversFromPanics(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	serv := newTestService()
+	serv.Register("Test.panic", func(message *Message, client *Client) {
+		panic("what")
+	}, nil)
+	go serv.Handle(server)
+
+	for i := 0; i < 2; i++ {
+		requestID, responseChan := sendTestRequest(t, requester, "Test.panic")
+		select {
+		case msg := <-responseChan:
+			if msg.RequestID != requestID || msg.ErrorCode != ErrorCodeInternal {
+				t.Errorf("unexpected reply: %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no reply after handler panic")
+		}
+	}
+
+	if counts := serv.PanicCounts(); counts["Test.panic~1"] != 2 {
+		t.Errorf("expected 2 panics, got %v", counts)
+	}
+}
+
+func TestServiceShutdownDrains(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	serv := newTestService()
+	serv.Register("Test.slow", func(message *Message, client *Client) {
+		started <- true
+		<-release
+		reply := NewResponseMessage()
+		reply.SetRequestID(message.RequestID)
+		client.Send(reply)
+	}, nil)
+	serv.clients = append(serv.clients, server)
+	go serv.Handle(server)
+
+	_, slowReplies := sendTestRequest(t, requester, "Test.slow")
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- serv.Shutdown(context.Background())
+	}()
+	for !serv.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// new requests are turned away while the slow one finishes
+	_, lateReplies := sendTestRequest(t, requester, "Test.slow")
+	select {
+	case msg := <-lateReplies:
+		if msg.ErrorCode != ErrorCodeUnavailable || !isRetryable(msg.Err()) {
+			t.Errorf("expected a retryable unavailable reply, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no reply for a request made while draining")
+	}
+
+	close(release)
+	select {
+	case msg := <-slowReplies:
+		if msg == nil || msg.Err() != nil {
+			t.Errorf("in-flight request was not answered: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("in-flight request was cut off")
+	}
+
+	<-shutdownErr
+}
+
+func TestServiceShutdownDeadline(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+
+	serv := newTestService()
+	serv.Register("Test.stuck", func(message *Message, client *Client) {
+		started <- true
+		<-release
+	}, nil)
+	go serv.Handle(server)
+
+	sendTestRequest(t, requester, "Test.stuck")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to cut shutdown short, got %v", err)
+	}
+}
+
+func TestServiceDispatchesOnVersion(t *testing.T) {
+	requester, server := newTestClientPair(t)
+	defer requester.Close()
+
+	serv := newTestService()
+	for _, version := range []int{1, 2} {
+		body := fmt.Sprintf("v%d", version)
+		serv.Register("Test.versioned", func(message *Message, client *Client) {
+			reply := NewResponseMessage()
+			reply.SetRequestID(message.RequestID)
+			reply.Write([]byte(body))
+			client.Send(reply)
+		}, &ActionOptions{Version: version})
+	}
+	if serv.Register("Test.versioned", func(*Message, *Client) {}, &ActionOptions{Version: 2}) == nil {
+		t.Errorf("registering the same version twice should fail")
+	}
+	go serv.Handle(server)
+
+	for version, expected := range map[int]string{0: "v1", 1: "v1", 2: "v2", 3: ""} {
+		msg := NewRequestMessage()
+		msg.SetAction("Test.versioned")
+		msg.SetVersion(version)
+		responseChan, err := requester.Send(msg)
+		if err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+
+		select {
+		case reply := <-responseChan:
+			if len(expected) == 0 {
+				if reply.ErrorCode != ErrorCodeUnknownVersion {
+					t.Errorf("version %d: expected unknown_version, got %+v", version, reply)
+				}
+			} else if string(reply.Bytes()) != expected {
+				t.Errorf("version %d: expected %s, got %s", version, expected, reply.Bytes())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("version %d: no reply", version)
+		}
+	}
+}
+
+func TestServiceUnknownVersionListsVersionsInOrder(t *testing.T) {
+	serv := newTestService()
+	for _, version := range []int{10, 2, 1} {
+		serv.Register("Test.versioned", func(*Message, *Client) {}, &ActionOptions{Version: version})
+	}
+
+	msg := NewRequestMessage()
+	msg.SetAction("Test.versioned")
+	msg.SetVersion(3)
+	_, err := serv.lookupAction(msg)
+	if err == nil || !strings.Contains(err.Error(), "(registered: 1, 2, 10)") {
+		t.Errorf("expected the registered versions in numeric order, got %v", err)
+	}
+}
+
+func TestRegisterCrudTags(t *testing.T) {
+	serv := newTestService()
+	err := serv.Register("Test.read", func(*Message, *Client) {}, &ActionOptions{CrudTags: []string{CrudRead}, Flags: []string{"noauth"}})
+	if err != nil {
+		t.Fatalf("register failed: %s", err)
+	}
+	if tags := serv.actions[actionKey("Test.read", 1)].crudTags; tags != "read,noauth" {
+		t.Errorf("unexpected crud tags `%s`", tags)
+	}
+
+	if serv.Register("Test.bad", func(*Message, *Client) {}, &ActionOptions{CrudTags: []string{"frobnicate"}}) == nil {
+		t.Errorf("unknown crud tags should be rejected")
+	}
+	if serv.Register("nodot", func(*Message, *Client) {}, nil) == nil {
+		t.Errorf("action names without a class should be rejected")
+	}
+}
@@ -3,11 +3,15 @@ package scamp
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ServiceCache struct {
@@ -16,6 +20,56 @@ type ServiceCache struct {
 	identIndex    map[string]*serviceProxy
 	actionIndex   map[string][]*serviceProxy
 	verifyRecords bool
+	// staleIntervals is how many announce intervals an instance may go without
+	// announcing before it is dropped. Zero disables the sweep.
+	staleIntervals float64
+
+	subscribersM   sync.Mutex
+	subscribers    map[int]func(CacheEvent)
+	nextSubscriber int
+
+	// modification time and size of the cache file at the last full parse, so Refresh
+	// can skip files that have not changed
+	fileM       sync.Mutex
+	fileModTime time.Time
+	fileSize    int64
+	// scannedWith is the authorized_services the last scan validated against, so
+	// Refresh re-reads an unchanged file once authorized_services changes
+	scannedWith *AuthorizedServicesCache
+	// clientCert is presented when dialing cached instances; see SetClientCertificate
+	clientCert *tls.Certificate
+}
+
+// CacheEventType says what happened to an instance in a CacheEvent
+type CacheEventType int
+
+const (
+	// CacheAdded is sent for instances seen for the first time
+	CacheAdded CacheEventType = iota
+	// CacheUpdated is sent when an instance announces something new: actions, weight,
+	// address or certificate. A fresh timestamp alone is not an update.
+	CacheUpdated
+	// CacheRemoved is sent when an instance leaves the cache
+	CacheRemoved
+)
+
+func (eventType CacheEventType) String() string {
+	switch eventType {
+	case CacheAdded:
+		return "added"
+	case CacheUpdated:
+		return "updated"
+	case CacheRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// CacheEvent describes a change to the instances in a ServiceCache
+type CacheEvent struct {
+	Type     CacheEventType
+	Ident    string
+	Instance *serviceProxy
 }
 
 func NewServiceCache(path string) (cache *ServiceCache, err error) {
@@ -35,21 +89,117 @@ func NewServiceCache(path string) (cache *ServiceCache, err error) {
 	return
 }
 
-func (cache *ServiceCache) DisableRecordVerification() {
+// NewMemoryServiceCache creates a ServiceCache that is not backed by a cache file. It is
+// filled with Store, usually by a DiscoveryListener.
+func NewMemoryServiceCache() (cache *ServiceCache) {
+	cache = new(ServiceCache)
+	cache.identIndex = make(map[string]*serviceProxy)
+	cache.actionIndex = make(map[string][]*serviceProxy)
 	cache.verifyRecords = true
+	return
 }
 
-func (cache *ServiceCache) EnableRecordVerification() {
+func (cache *ServiceCache) DisableRecordVerification() {
 	cache.verifyRecords = false
 }
 
+func (cache *ServiceCache) EnableRecordVerification() {
+	cache.verifyRecords = true
+}
+
+// EnableStaleSweep drops instances that have not announced for more than intervals
+// times their announce interval, judged by the timestamp in their announcement
+func (cache *ServiceCache) EnableStaleSweep(intervals float64) {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+	cache.staleIntervals = intervals
+}
+
+// DisableStaleSweep keeps instances for as long as they are in the cache file
+func (cache *ServiceCache) DisableStaleSweep() {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+	cache.staleIntervals = 0
+}
+
+// Subscribe calls fn for every instance that is added, updated or removed. Events are
+// delivered on the goroutine that changed the cache, after the change is visible.
+// The returned function cancels the subscription.
+func (cache *ServiceCache) Subscribe(fn func(CacheEvent)) (unsubscribe func()) {
+	cache.subscribersM.Lock()
+	defer cache.subscribersM.Unlock()
+
+	if cache.subscribers == nil {
+		cache.subscribers = make(map[int]func(CacheEvent))
+	}
+	id := cache.nextSubscriber
+	cache.nextSubscriber++
+	cache.subscribers[id] = fn
+
+	return func() {
+		cache.subscribersM.Lock()
+		defer cache.subscribersM.Unlock()
+		delete(cache.subscribers, id)
+	}
+}
+
+func (cache *ServiceCache) publish(events []CacheEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	cache.subscribersM.Lock()
+	subscribers := make([]func(CacheEvent), 0, len(cache.subscribers))
+	for _, fn := range cache.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	cache.subscribersM.Unlock()
+
+	for _, event := range events {
+		for _, fn := range subscribers {
+			fn(event)
+		}
+	}
+}
+
+// Store adds or updates instance. A zero-weight (going-away) announcement removes it.
 func (cache *ServiceCache) Store(instance *serviceProxy) {
+	cache.cacheM.Lock()
+	var events []CacheEvent
+	if instance.weight <= 0 {
+		events = cache.removeNoLock(instance.ident, events)
+	} else {
+		events = cache.upsertNoLock(instance, events)
+	}
+	cache.cacheM.Unlock()
+
+	cache.publish(events)
+}
+
+// SetClientCertificate makes connections to the cached instances present cert, so
+// services that ask for client certificates (see Service.SetClientAuth) can tell who is
+// calling. A service usually presents its own keypair (Service.Certificate). Connections
+// that are already open keep the certificate they were made with.
+func (cache *ServiceCache) SetClientCertificate(cert tls.Certificate) {
 	cache.cacheM.Lock()
 	defer cache.cacheM.Unlock()
 
-	cache.storeNoLock(instance)
+	cache.clientCert = &cert
+	for _, instance := range cache.identIndex {
+		instance.setClientCertificate(cache.clientCert)
+	}
+}
 
-	return
+// Remove drops the instances with the given idents
+func (cache *ServiceCache) Remove(idents ...string) {
+	cache.cacheM.Lock()
+	var events []CacheEvent
+	for _, ident := range idents {
+		events = cache.removeNoLock(ident, events)
+	}
+	cache.cacheM.Unlock()
+
+	cache.publish(events)
 }
 
 func (cache *ServiceCache) ActionList() []string {
@@ -62,56 +212,176 @@ func (cache *ServiceCache) ActionList() []string {
 	return actions
 }
 
-func (cache *ServiceCache) storeNoLock(instance *serviceProxy) {
-	_, ok := cache.identIndex[instance.ident]
+// upsertNoLock stores and indexes instance under its ident. When the ident is already
+// known and still reachable at the same address with the same certificate, the pooled
+// client is handed over so the connection survives the refresh.
+func (cache *ServiceCache) upsertNoLock(instance *serviceProxy, events []CacheEvent) []CacheEvent {
+	existing, ok := cache.identIndex[instance.ident]
+	if ok && existing == instance {
+		return events
+	}
+	if ok {
+		cache.unindexNoLock(existing)
+	}
+	instance.setClientCertificate(cache.clientCert)
+	cache.identIndex[instance.ident] = instance
+	cache.indexNoLock(instance)
+
 	if !ok {
-		cache.identIndex[instance.ident] = instance
-	} else {
-		// Not sure if this is a hard error yet
-		// Error.Printf("tried to store instance that was already tracked")
-		// Override existing version. Correct logic?
-		cache.identIndex[instance.ident] = instance
+		return append(events, CacheEvent{Type: CacheAdded, Ident: instance.ident, Instance: instance})
 	}
 
-	for _, class := range instance.classes {
-		for _, action := range class.actions {
-			for _, protocol := range instance.protocols {
-				mungedName := strings.ToLower(fmt.Sprintf("%s:%s.%s~%d#%s", instance.sector, class.className, action.actionName, action.version, protocol))
+	if existing.connspec == instance.connspec && bytes.Equal(existing.rawCert, instance.rawCert) {
+		existing.clientM.Lock()
+		client := existing.client
+		existing.clientM.Unlock()
 
-				serviceProxies, ok := cache.actionIndex[mungedName]
-				if ok {
-					serviceProxies = append(serviceProxies, instance)
-				} else {
-					serviceProxies = []*serviceProxy{instance}
-				}
+		instance.clientM.Lock()
+		handedOver := instance.client == nil && client != nil
+		if handedOver {
+			instance.client = client
+		}
+		instance.clientM.Unlock()
+		if handedOver {
+			client.setProxy(instance)
+		}
+	}
 
-				cache.actionIndex[mungedName] = serviceProxies
-			}
+	if sameAnnouncement(existing, instance) {
+		return events
+	}
+	return append(events, CacheEvent{Type: CacheUpdated, Ident: instance.ident, Instance: instance})
+}
+
+// sameRecords reports whether two instances were built from the same records apart
+// from the timestamp, which every announcement is stamped with afresh. A validated one
+// vouches for the other: the timestamp is only used to sweep stale instances.
+func sameRecords(a, b *serviceProxy) bool {
+	if !bytes.Equal(a.rawCert, b.rawCert) {
+		return false
+	}
+	if bytes.Equal(a.rawClassRecords, b.rawClassRecords) {
+		return true
+	}
+
+	var aRecords, bRecords []json.RawMessage
+	if json.Unmarshal(a.rawClassRecords, &aRecords) != nil || json.Unmarshal(b.rawClassRecords, &bRecords) != nil {
+		return false
+	}
+	if len(aRecords) != len(bRecords) || len(aRecords) <= announcementTimestampRecord {
+		return false
+	}
+	for i := range aRecords {
+		if i != announcementTimestampRecord && !bytes.Equal(aRecords[i], bRecords[i]) {
+			return false
 		}
 	}
+	return true
+}
 
-	return
+// sameAnnouncement reports whether two announcements of an ident differ in nothing but
+// their timestamp
+func sameAnnouncement(a, b *serviceProxy) bool {
+	return a.sector == b.sector &&
+		a.weight == b.weight &&
+		a.announceInterval == b.announceInterval &&
+		a.connspec == b.connspec &&
+		bytes.Equal(a.rawCert, b.rawCert) &&
+		reflect.DeepEqual(a.protocols, b.protocols) &&
+		reflect.DeepEqual(a.classes, b.classes)
 }
 
-func (cache *ServiceCache) removeNoLock(instance *serviceProxy) (err error) {
-	_, ok := cache.identIndex[instance.ident]
+func (cache *ServiceCache) removeNoLock(ident string, events []CacheEvent) []CacheEvent {
+	instance, ok := cache.identIndex[ident]
 	if !ok {
-		err = fmt.Errorf("tried removing an ident which was not being tracked: %s", instance.ident)
-		return
+		return events
 	}
 
-	delete(cache.identIndex, instance.ident)
+	delete(cache.identIndex, ident)
+	cache.unindexNoLock(instance)
+	return append(events, CacheEvent{Type: CacheRemoved, Ident: ident, Instance: instance})
+}
 
+// actionKeys lists the actionIndex entries instance belongs in
+func actionKeys(instance *serviceProxy) (keys []string) {
+	for _, class := range instance.classes {
+		for _, action := range class.actions {
+			sector := instance.actionSector(action)
+			for _, protocol := range instance.actionEnvelopes(action) {
+				keys = append(keys, strings.ToLower(fmt.Sprintf("%s:%s.%s~%d#%s", sector, class.className, action.actionName, action.version, protocol)))
+			}
+		}
+	}
 	return
 }
 
-// TODO: in a perfect world we'd do upserts to the cache
-// and sweep for stale proxy definitions.
-func (cache *ServiceCache) clearNoLock() (err error) {
-	cache.identIndex = make(map[string]*serviceProxy)
-	cache.actionIndex = make(map[string][]*serviceProxy)
+// indexNoLock adds instance to the actionIndex entries of its actions. SearchByAction
+// hands entries out without copying, so they are replaced rather than appended to.
+func (cache *ServiceCache) indexNoLock(instance *serviceProxy) {
+	for _, key := range actionKeys(instance) {
+		instances := cache.actionIndex[key]
+		cache.actionIndex[key] = append(instances[:len(instances):len(instances)], instance)
+	}
+}
 
-	return
+// unindexNoLock removes instance from the actionIndex entries of its actions
+func (cache *ServiceCache) unindexNoLock(instance *serviceProxy) {
+	for _, key := range actionKeys(instance) {
+		instances := cache.actionIndex[key]
+		remaining := make([]*serviceProxy, 0, len(instances))
+		for _, indexed := range instances {
+			if indexed != instance {
+				remaining = append(remaining, indexed)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(cache.actionIndex, key)
+		} else {
+			cache.actionIndex[key] = remaining
+		}
+	}
+}
+
+// isStaleNoLock reports whether instance has stopped announcing
+func (cache *ServiceCache) isStaleNoLock(instance *serviceProxy, now time.Time) bool {
+	if cache.staleIntervals <= 0 {
+		return false
+	}
+
+	announcedAt := instance.announcedAt()
+	if announcedAt.IsZero() {
+		return false
+	}
+
+	interval := instance.announcePeriod()
+	return now.Sub(announcedAt) > time.Duration(cache.staleIntervals*float64(interval))
+}
+
+// SweepStale removes every instance that has stopped announcing. Refresh does this on
+// its own; caches filled with Store should call it periodically.
+func (cache *ServiceCache) SweepStale() {
+	cache.cacheM.Lock()
+	var events []CacheEvent
+	now := time.Now()
+	for ident, instance := range cache.identIndex {
+		if cache.isStaleNoLock(instance, now) {
+			events = cache.removeNoLock(ident, events)
+		}
+	}
+	cache.cacheM.Unlock()
+
+	cache.publish(events)
+}
+
+// reuse is reuseNoLock for announcements heard outside of a scan
+func (cache *ServiceCache) reuse(instance *serviceProxy) (stored *serviceProxy, reused bool) {
+	authorized, authErr := defaultAuthorizedServices()
+
+	cache.cacheM.RLock()
+	defer cache.cacheM.RUnlock()
+
+	return cache.reuseNoLock(instance, authorized, authErr)
 }
 
 func (cache *ServiceCache) Retrieve(ident string) (instance *serviceProxy) {
@@ -134,7 +404,7 @@ func (cache *ServiceCache) SearchByAction(sector, action string, version int, en
 	mungedName := strings.ToLower(fmt.Sprintf("%s:%s~%d#%s", sector, action, version, envelope))
 	instances = cache.actionIndex[mungedName]
 	if len(instances) == 0 {
-		err = fmt.Errorf("no instances found of %s", mungedName)
+		err = &NoInstancesError{Sector: sector, Action: action, Version: version, Envelope: envelope}
 		return
 	}
 	return
@@ -168,9 +438,14 @@ var (
 	newline = []byte("\n")
 )
 
+// Refresh re-reads the cache file. The file is only parsed when its modification time
+// or size differ from the last parse; otherwise only stale instances are swept. Caches
+// without a file are only swept.
 func (cache *ServiceCache) Refresh() (err error) {
-	cache.cacheM.Lock()
-	defer cache.cacheM.Unlock()
+	if cache.path == "" {
+		cache.SweepStale()
+		return
+	}
 
 	stat, err := os.Stat(cache.path)
 	if err != nil {
@@ -180,23 +455,115 @@ func (cache *ServiceCache) Refresh() (err error) {
 		return
 	}
 
+	cache.fileM.Lock()
+	defer cache.fileM.Unlock()
+
+	if stat.ModTime().Equal(cache.fileModTime) && stat.Size() == cache.fileSize && cache.authorizationCurrent() {
+		cache.SweepStale()
+		return
+	}
+
+	err = cache.refreshFrom()
+	return
+}
+
+// refreshFrom parses the cache file and records the stat it was parsed at. fileM must
+// be held.
+func (cache *ServiceCache) refreshFrom() (err error) {
 	cacheHandle, err := os.Open(cache.path)
 	if err != nil {
 		return
 	}
 	defer cacheHandle.Close()
 
+	// stat the open handle so a rename landing mid-parse is picked up next time
+	stat, err := cacheHandle.Stat()
+	if err != nil {
+		return
+	}
+
 	s := bufio.NewScanner(cacheHandle)
 	err = cache.DoScan(s)
 	if err != nil {
+		cache.fileModTime = time.Time{}
+		cache.fileSize = 0
 		return
 	}
 
+	cache.fileModTime = stat.ModTime()
+	cache.fileSize = stat.Size()
 	return
 }
 
+// DoScan reads a full cache file and brings the cache in line with it. Instances whose
+// record is byte-for-byte unchanged are kept without re-verifying their signature;
+// instances missing from the file, going away or stale are removed. Subscribers are
+// told about every change once the scan is done.
 func (cache *ServiceCache) DoScan(s *bufio.Scanner) (err error) {
-	cache.clearNoLock()
+	cache.cacheM.Lock()
+	events, err := cache.scanNoLock(s)
+	cache.cacheM.Unlock()
+
+	cache.publish(events)
+	return
+}
+
+// authorizationCurrent reports whether the cached instances were validated against the
+// authorized_services in force now
+func (cache *ServiceCache) authorizationCurrent() bool {
+	if !cache.verifyRecords {
+		return true
+	}
+	authorized, err := defaultAuthorizedServices()
+	if err != nil {
+		return false
+	}
+
+	cache.cacheM.RLock()
+	defer cache.cacheM.RUnlock()
+	return cache.scannedWith == authorized
+}
+
+// reuseNoLock looks for a stored copy of instance built from the same records (see
+// sameRecords) and validated against the current authorized_services. When there is
+// one, instance needs no validating: stored is the copy itself if nothing changed at
+// all, or else instance carrying the copy's validated actions and its own timestamp.
+func (cache *ServiceCache) reuseNoLock(instance *serviceProxy, authorized *AuthorizedServicesCache, authErr error) (stored *serviceProxy, reused bool) {
+	existing := cache.identIndex[instance.ident]
+	if existing == nil || !cache.reusableNoLock(existing, authorized, authErr) || !sameRecords(existing, instance) {
+		return instance, false
+	}
+
+	if bytes.Equal(existing.rawClassRecords, instance.rawClassRecords) && bytes.Equal(existing.rawSig, instance.rawSig) {
+		return existing, true
+	}
+	instance.classes = existing.classes
+	instance.validated = existing.validated
+	instance.authorizedBy = existing.authorizedBy
+	return instance, true
+}
+
+// reusableNoLock reports whether existing, built from the same records as a newly read
+// announcement, can stand in for it without validating it again
+func (cache *ServiceCache) reusableNoLock(existing *serviceProxy, authorized *AuthorizedServicesCache, authErr error) bool {
+	if !cache.verifyRecords {
+		return true
+	}
+	return authErr == nil && existing.validatedAgainst(authorized)
+}
+
+func (cache *ServiceCache) scanNoLock(s *bufio.Scanner) (events []CacheEvent, err error) {
+	seen := make(map[string]bool)
+	now := time.Now()
+
+	// looked up once per scan; each Validate looks it up again, but it is only
+	// reloaded when the file changes
+	authorized, authErr := defaultAuthorizedServices()
+	defer func() {
+		if err == nil && authErr == nil {
+			cache.scannedWith = authorized
+		}
+	}()
 
 	// var entries int = 0
 	// Scan through buf by lines according to this basic ABNF
@@ -269,25 +636,38 @@ func (cache *ServiceCache) DoScan(s *bufio.Scanner) (err error) {
 		// Use those extracted value to make an instance
 		serviceProxy, err := newServiceProxy(classRecordsRaw, certRaw, sigRaw)
 		if err != nil {
-			return fmt.Errorf("newServiceProxy: %s", err)
+			return events, fmt.Errorf("newServiceProxy: %s", err)
 		}
 
-		// Validating is a very expensive operation in the benchmarks
-		if cache.verifyRecords {
+		existing := cache.identIndex[serviceProxy.ident]
+		serviceProxy, reused := cache.reuseNoLock(serviceProxy, authorized, authErr)
+		if !reused && cache.verifyRecords {
+			// Validating is a very expensive operation in the benchmarks
 			err = serviceProxy.Validate()
 			if err != nil {
-				err = cache.removeNoLock(serviceProxy)
-				if err != nil {
-					Error.Printf("could not remove service proxy (benign on first pass, otherwise it means the service has gone to a bad state): `%s`", err)
-				}
+				Error.Printf("dropping %s: %s", serviceProxy.ident, err)
 				continue
 			}
 		}
 
-		cache.storeNoLock(serviceProxy)
+		// a weight of zero is a going-away announcement
+		if serviceProxy.weight <= 0 || cache.isStaleNoLock(serviceProxy, now) {
+			continue
+		}
+
+		seen[serviceProxy.ident] = true
+		if serviceProxy != existing {
+			events = cache.upsertNoLock(serviceProxy, events)
+		}
 	}
 
-	return
+	for ident := range cache.identIndex {
+		if !seen[ident] {
+			events = cache.removeNoLock(ident, events)
+		}
+	}
+
+	return events, nil
 }
 
 var (
@@ -315,8 +695,7 @@ func scanCertficates(data []byte, atEOF bool) (advance int, token []byte, err er
 }
 
 // RETRY LOGIC
-// TODO: cannot implement rety until cache.Refresh() is rewritten to support updating the cache rather than clearing and rebuilding
-// each time it is called
+// Used by ScampRequester to fail over idempotent requests between instances.
 
 // MaxRetries is the maximum number of retries before bailing.
 var MaxRetries = 10
@@ -329,6 +708,11 @@ type Func func(attempt int) (retry bool, err error)
 // Do keeps trying the function until the second argument
 // returns false, or no error is returned.
 func Do(fn Func) error {
+	return DoLimit(MaxRetries, fn)
+}
+
+// DoLimit is Do with an explicit limit on the number of attempts
+func DoLimit(limit int, fn Func) error {
 	var err error
 	var cont bool
 	attempt := 1
@@ -338,7 +722,7 @@ func Do(fn Func) error {
 			break
 		}
 		attempt++
-		if attempt > MaxRetries {
+		if attempt > limit {
 			return errMaxRetriesReached
 		}
 	}
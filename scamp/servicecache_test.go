@@ -0,0 +1,181 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func cacheFileOf(t *testing.T, announcements ...[]byte) *bufio.Scanner {
+	var buf bytes.Buffer
+	for _, announcement := range announcements {
+		buf.Write(sep)
+		buf.Write(newline)
+		buf.Write(announcement)
+	}
+	return bufio.NewScanner(&buf)
+}
+
+func announcementOf(t *testing.T, serv *Service) []byte {
+	announcement, err := serv.marshalAnnouncement(false)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	return announcement
+}
+
+func TestServiceCacheIncrementalRefresh(t *testing.T) {
+	initSCAMPLogger()
+	first := newAnnouncedTestService(t)
+	first.name = "first-1234"
+	second := newAnnouncedTestService(t)
+	second.name = "second-1234"
+
+	cache := &ServiceCache{
+		identIndex:    make(map[string]*serviceProxy),
+		actionIndex:   make(map[string][]*serviceProxy),
+		verifyRecords: true,
+	}
+	var events []CacheEvent
+	cache.Subscribe(func(event CacheEvent) {
+		events = append(events, event)
+	})
+
+	firstAnnouncement := announcementOf(t, first)
+	err := cache.DoScan(cacheFileOf(t, firstAnnouncement, announcementOf(t, second)))
+	if err != nil || cache.Size() != 2 || len(events) != 2 || events[0].Type != CacheAdded {
+		t.Fatalf("expected two added instances, got %+v (%v)", events, err)
+	}
+
+	pooled := &Client{}
+	cache.Retrieve("first-1234").client = pooled
+	events = nil
+
+	// nothing changed
+	cache.DoScan(cacheFileOf(t, firstAnnouncement, announcementOf(t, second)))
+	if len(events) != 0 || cache.Retrieve("first-1234").client != pooled {
+		t.Fatalf("an unchanged refresh should keep proxies and send no events, got %+v", events)
+	}
+
+	// first re-announces with a new timestamp and weight, second disappears
+	time.Sleep(time.Millisecond)
+	first.SetWeight(3)
+	cache.DoScan(cacheFileOf(t, announcementOf(t, first)))
+	if len(events) != 2 {
+		t.Fatalf("expected an update and a removal, got %+v", events)
+	}
+	for _, event := range events {
+		switch event.Ident {
+		case "first-1234":
+			if event.Type != CacheUpdated || event.Instance.weight != 3 {
+				t.Errorf("unexpected event for first: %+v", event)
+			}
+		case "second-1234":
+			if event.Type != CacheRemoved {
+				t.Errorf("unexpected event for second: %+v", event)
+			}
+		}
+	}
+	if cache.Retrieve("first-1234").client != pooled {
+		t.Errorf("the pooled client should survive an update")
+	}
+
+	instances, err := cache.SearchByAction("main", "Logging.info", 1, "json")
+	if err != nil || len(instances) != 1 || instances[0].ident != "first-1234" {
+		t.Errorf("action index was not rebuilt: %v (%v)", instances, err)
+	}
+}
+
+func TestServiceCacheStoreUpdatesIndex(t *testing.T) {
+	cache := NewMemoryServiceCache()
+	first := newAnnouncedTestService(t)
+	first.name = "first-1234"
+	second := newAnnouncedTestService(t)
+	second.name = "second-1234"
+
+	cache.Store(serviceAsServiceProxy(first))
+	cache.Store(serviceAsServiceProxy(second))
+	handedOut, err := cache.SearchByAction("main", "Logging.info", 1, "json")
+	if err != nil || len(handedOut) != 2 {
+		t.Fatalf("expected both instances, got %v (%v)", handedOut, err)
+	}
+	before := append([]*serviceProxy(nil), handedOut...)
+
+	first.Register("Logging.warn", func(_ *Message, _ *Client) {}, nil)
+	cache.Store(serviceAsServiceProxy(first))
+	cache.Remove("second-1234")
+
+	instances, err := cache.SearchByAction("main", "Logging.info", 1, "json")
+	if err != nil || len(instances) != 1 || instances[0] != cache.Retrieve("first-1234") {
+		t.Errorf("expected only the updated first instance, got %v (%v)", instances, err)
+	}
+	if instances, err = cache.SearchByAction("main", "Logging.warn", 1, "json"); err != nil || len(instances) != 1 {
+		t.Errorf("the new action was not indexed: %v (%v)", instances, err)
+	}
+	for i := range before {
+		if handedOut[i] != before[i] {
+			t.Errorf("a result already handed out was modified")
+		}
+	}
+
+	first.SetWeight(0)
+	cache.Store(serviceAsServiceProxy(first))
+	if actions := cache.ActionList(); len(actions) != 0 {
+		t.Errorf("removed instances left index entries behind: %v", actions)
+	}
+}
+
+func TestServiceCacheSweepsStaleInstances(t *testing.T) {
+	cache := &ServiceCache{
+		identIndex:  make(map[string]*serviceProxy),
+		actionIndex: make(map[string][]*serviceProxy),
+	}
+	announced := highResTimestamp(float64(time.Now().Add(-time.Minute).UnixNano()) / float64(time.Second))
+	cache.Store(&serviceProxy{ident: "quiet", weight: 1, announceInterval: 5000, timestamp: announced})
+	cache.Store(&serviceProxy{ident: "chatty", weight: 1, announceInterval: 60000, timestamp: announced})
+
+	cache.SweepStale()
+	if cache.Size() != 2 {
+		t.Fatalf("sweeping should be off by default")
+	}
+
+	var removed []string
+	cache.Subscribe(func(event CacheEvent) {
+		if event.Type == CacheRemoved {
+			removed = append(removed, event.Ident)
+		}
+	})
+	cache.EnableStaleSweep(3)
+	cache.SweepStale()
+	if cache.Size() != 1 || len(removed) != 1 || removed[0] != "quiet" {
+		t.Errorf("expected only the quiet instance to be swept, removed %v", removed)
+	}
+}
+
+func TestServiceCacheSweepsStaleAnnouncements(t *testing.T) {
+	serv := newAnnouncedTestService(t)
+	cache := scanAnnouncement(t, announcementOf(t, serv))
+	instance := cache.Retrieve("announced-1234")
+	if instance == nil || time.Since(instance.announcedAt()) > time.Minute {
+		t.Fatalf("the announcement's timestamp was not parsed")
+	}
+
+	cache.EnableStaleSweep(3)
+	cache.SweepStale()
+	if cache.Size() != 1 {
+		t.Errorf("a fresh announcement should not be swept")
+	}
+}
+
+func TestServiceCacheRecordVerificationToggle(t *testing.T) {
+	cache := &ServiceCache{}
+	cache.DisableRecordVerification()
+	if cache.verifyRecords {
+		t.Errorf("DisableRecordVerification should turn verification off")
+	}
+	cache.EnableRecordVerification()
+	if !cache.verifyRecords {
+		t.Errorf("EnableRecordVerification should turn verification on")
+	}
+}
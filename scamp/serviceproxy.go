@@ -2,17 +2,20 @@ package scamp
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"log"
 
+	"sort"
 	"strconv"
 
 	"fmt"
 	"strings"
 
 	"sync"
+	"time"
 
 	"net"
 	u "net/url"
@@ -45,8 +48,14 @@ type serviceProxy struct {
 	rawCert          []byte
 	rawSig           []byte
 	timestamp        highResTimestamp
-	clientM          sync.Mutex
-	client           *Client
+	// validated is set by a successful Validate, and authorizedBy to the
+	// authorized_services it checked against (nil when none is configured)
+	validated    bool
+	authorizedBy *AuthorizedServicesCache
+	clientM      sync.Mutex
+	client       *Client
+	// clientCert is presented when dialing the instance; set by the cache holding it
+	clientCert *tls.Certificate
 }
 
 func (sp *serviceProxy) GetClient() (client *Client, err error) {
@@ -54,17 +63,26 @@ func (sp *serviceProxy) GetClient() (client *Client, err error) {
 	defer sp.clientM.Unlock()
 
 	//TODO: what really needs to happen is the removal of closed client from sp.client. Checking `sp.client.isClosed` is a bandaid
-	if sp.client == nil || sp.client.isClosed {
+	if sp.client == nil || sp.client.closed() {
 		var url *u.URL
 		url, err = u.Parse(sp.connspec)
 		if err != nil {
 			return nil, err
 		}
 
-		sp.client, err = Dial(url.Host)
+		// only talk to the instance holding the certificate it announced
+		var fingerprint string
+		fingerprint, err = pemFingerPrint(sp.rawCert)
+		if err != nil {
+			return nil, &VerificationError{Err: fmt.Errorf("announced certificate of %s: %s", sp.ident, err)}
+		}
+
+		sp.client, err = DialWithOptions(url.Host, DialOptions{Fingerprint: fingerprint, Certificate: sp.clientCert})
 		if err != nil {
 			return
 		}
+		// so that client.Close() can set the service proxy's client to nil
+		sp.client.setProxy(sp)
 	}
 
 	client = sp.client
@@ -72,12 +90,19 @@ func (sp *serviceProxy) GetClient() (client *Client, err error) {
 		return nil, fmt.Errorf("client is nil")
 	}
 
-	//using ident so that we can set the service proxy's client to nil in client.Close()
-	client.spIdent = sp.ident
-
 	return
 }
 
+// clearClient drops the pooled client if it is still client, so the next GetClient redials
+func (sp *serviceProxy) clearClient(client *Client) {
+	sp.clientM.Lock()
+	defer sp.clientM.Unlock()
+
+	if sp.client == client {
+		sp.client = nil
+	}
+}
+
 func (sp *serviceProxy) Ident() string {
 	return sp.ident
 }
@@ -116,6 +141,48 @@ func (sp *serviceProxy) ConnSpec() string {
 	return sp.connspec
 }
 
+// Weight is the instance's announced weight. Zero means the instance is going away:
+// caches never hold such an instance, so balancers only see weights of 1 and up.
+func (sp *serviceProxy) Weight() int {
+	return sp.weight
+}
+
+// Outstanding counts requests sent to this instance that are still awaiting a reply
+func (sp *serviceProxy) Outstanding() int {
+	sp.clientM.Lock()
+	client := sp.client
+	sp.clientM.Unlock()
+
+	if client == nil {
+		return 0
+	}
+	return client.outstanding()
+}
+
+// setClientCertificate sets the certificate presented when the instance is next dialed
+func (sp *serviceProxy) setClientCertificate(cert *tls.Certificate) {
+	sp.clientM.Lock()
+	defer sp.clientM.Unlock()
+	sp.clientCert = cert
+}
+
+// announcedAt is when the instance made its announcement, or the zero time if unknown
+func (sp *serviceProxy) announcedAt() time.Time {
+	if sp.timestamp <= 0 {
+		return time.Time{}
+	}
+	return sp.timestamp.Time()
+}
+
+// announcePeriod is how often the instance says it announces, or the default interval
+// if it doesn't say
+func (sp *serviceProxy) announcePeriod() time.Duration {
+	if sp.announceInterval <= 0 {
+		return time.Duration(defaultAnnounceInterval) * time.Second
+	}
+	return time.Duration(sp.announceInterval) * time.Millisecond
+}
+
 func (sp *serviceProxy) Sector() string {
 	return sp.sector
 }
@@ -141,6 +208,10 @@ type actionDescription struct {
 	actionName string
 	crudTags   string
 	version    int
+	// sector and envelopes are only set when they differ from the instance's; such
+	// actions are announced in the v4 extension
+	sector    string
+	envelopes []string
 }
 
 func (ad actionDescription) Name() string {
@@ -156,8 +227,8 @@ func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
 	sp.version = 3
 	sp.ident = serv.name
 	sp.sector = serv.sector
-	sp.weight = 1
-	sp.announceInterval = defaultAnnounceInterval * 500
+	sp.weight = serv.Weight()
+	sp.announceInterval = int(serv.AnnounceInterval() / time.Millisecond)
 	sp.connspec = fmt.Sprintf("beepish+tls://%s:%d", serv.listenerIP.To4().String(), serv.listenerPort)
 	sp.protocols = make([]string, 1, 1)
 	sp.protocols[0] = "json"
@@ -166,8 +237,15 @@ func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
 	sp.rawCert = []byte("rawCert")
 	sp.rawSig = []byte("rawSig")
 
+	serv.actionsM.Lock()
+	defer serv.actionsM.Unlock()
+
 	// { "Logger.info": [{ "name": "blah", "callback": foo() }] }
-	for classAndActionName, serviceAction := range serv.actions {
+	// Actions are grouped into one record per class, like other SCAMP implementations
+	// announce them. Sorted so announcements are stable.
+	classIndex := make(map[string]int)
+	for _, serviceAction := range serv.actions {
+		classAndActionName := serviceAction.name
 		actionDotIndex := strings.LastIndex(classAndActionName, ".")
 		// TODO: this is the only spot that could fail? shouldn't happen in any usage...
 		if actionDotIndex == -1 {
@@ -177,19 +255,36 @@ func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
 
 		actionName := classAndActionName[actionDotIndex+1 : len(classAndActionName)]
 
-		newServiceProxyClass := serviceProxyClass{
-			className: className,
-			actions:   make([]actionDescription, 0),
+		index, ok := classIndex[className]
+		if !ok {
+			index = len(sp.classes)
+			classIndex[className] = index
+			sp.classes = append(sp.classes, serviceProxyClass{
+				className: className,
+				actions:   make([]actionDescription, 0),
+			})
 		}
 
-		newServiceProxyClass.actions = append(newServiceProxyClass.actions, actionDescription{
+		sp.classes[index].actions = append(sp.classes[index].actions, actionDescription{
 			actionName: actionName,
 			crudTags:   serviceAction.crudTags,
 			version:    serviceAction.version,
+			envelopes:  serviceAction.envelopes,
+			sector:     serviceAction.sector,
 		})
+	}
 
-		sp.classes = append(sp.classes, newServiceProxyClass)
-
+	sort.Slice(sp.classes, func(i, j int) bool {
+		return sp.classes[i].className < sp.classes[j].className
+	})
+	for _, class := range sp.classes {
+		actions := class.actions
+		sort.Slice(actions, func(i, j int) bool {
+			if actions[i].actionName != actions[j].actionName {
+				return actions[i].actionName < actions[j].actionName
+			}
+			return actions[i].version < actions[j].version
+		})
 	}
 
 	timestamp, err := getTimeOfDay()
@@ -202,6 +297,10 @@ func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
 	return
 }
 
+// announcementTimestampRecord is the position of the timestamp in an announcement's
+// class records
+const announcementTimestampRecord = 8
+
 func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp *serviceProxy, err error) {
 	sp = new(serviceProxy)
 	sp.rawClassRecords = classRecordsRaw
@@ -343,6 +442,18 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 		}
 	}
 
+	// the timestamp is only used to sweep stale instances, so one that doesn't parse is
+	// treated as unknown
+	var timestamp float64
+	if json.Unmarshal(classRecords[announcementTimestampRecord], &timestamp) == nil {
+		sp.timestamp = highResTimestamp(timestamp)
+	}
+
+	err = sp.applyExtension()
+	if err != nil {
+		return nil, err
+	}
+
 	sp.client = nil // we connect on demand
 	return
 }
@@ -351,17 +462,59 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 // 2) Make sure the fingerprint is in authorized_services
 // 3) Filter announced actions against authorized actions
 func (sp *serviceProxy) Validate() (err error) {
-	_, err = sp.validateSignature()
+	fingerprint, err := sp.validateSignature()
+	if err != nil {
+		return
+	}
+
+	authorized, err := defaultAuthorizedServices()
 	if err != nil {
 		return
 	}
 
-	// See if we have this fingerprint in our authorized_services
-	// TODO
+	if authorized != nil {
+		spec := authorized.Lookup(fingerprint)
+		if spec == nil {
+			return fmt.Errorf("certificate %s is not in authorized_services", fingerprint)
+		}
+		sp.filterActions(spec)
+	}
 
+	sp.validated = true
+	sp.authorizedBy = authorized
 	return
 }
 
+// validatedAgainst reports whether Validate accepted the instance under authorized, as
+// returned by defaultAuthorizedServices. Once authorized_services is reloaded an
+// instance must be validated again, since the actions it may offer can have changed.
+func (sp *serviceProxy) validatedAgainst(authorized *AuthorizedServicesCache) bool {
+	return sp.validated && sp.authorizedBy == authorized
+}
+
+// filterActions drops the announced actions spec does not authorize, so they never
+// reach a cache's action index. The classes are rebuilt rather than filtered in place,
+// since they may share their backing array with another copy of the instance.
+func (sp *serviceProxy) filterActions(spec *AuthorizedServiceSpec) {
+	classes := make([]serviceProxyClass, 0, len(sp.classes))
+	for _, class := range sp.classes {
+		actions := make([]actionDescription, 0, len(class.actions))
+		for _, action := range class.actions {
+			name := class.className + "." + action.actionName
+			if spec.Authorizes(sp.actionSector(action), name) {
+				actions = append(actions, action)
+			} else {
+				Info.Printf("%s is not authorized to offer %s:%s", sp.ident, sp.actionSector(action), name)
+			}
+		}
+		if len(actions) > 0 {
+			class.actions = actions
+			classes = append(classes, class)
+		}
+	}
+	sp.classes = classes
+}
+
 func (sp *serviceProxy) validateSignature() (hexSha1 string, err error) {
 	decoded, _ := pem.Decode(sp.rawCert)
 	if decoded == nil {
@@ -400,29 +553,42 @@ func (sp *serviceProxy) MarshalJSON() (b []byte, err error) {
 	arr[3] = &sp.weight
 	arr[4] = &sp.announceInterval
 	arr[5] = &sp.connspec
-	arr[6] = &sp.protocols
+
+	// actions with their own sector or envelopes go in the v4 extension, which rides
+	// along in the protocols list
+	protocols := make([]interface{}, 0, len(sp.protocols)+1)
+	for _, protocol := range sp.protocols {
+		protocols = append(protocols, protocol)
+	}
+	if extension := sp.buildExtension(); extension != nil {
+		protocols = append(protocols, extension)
+	}
+	arr[6] = &protocols
 
 	// TODO: move this to two MarshalJSON interfaces for `ServiceProxyClass` and `ActionDescription`
 	// doing so should remove manual copies and separate concerns
 	//
 	// Serialize actions in this format:
 	// 	["bgdispatcher",["poll","",1],["reboot","",1],["report","",1]]
-	classSpecs := make([][]interface{}, len(sp.classes), len(sp.classes))
-	for i, class := range sp.classes {
-		entry := make([]interface{}, 1+len(class.actions), 1+len(class.actions))
+	classSpecs := make([][]interface{}, 0, len(sp.classes))
+	for _, class := range sp.classes {
+		entry := make([]interface{}, 1, 1+len(class.actions))
 		entry[0] = class.className
-		for j, action := range class.actions {
-			actions := make([]interface{}, 3, 3)
+		for _, action := range class.actions {
+			if !sp.inV3(action) {
+				continue
+			}
 
-			actionNameCopy := make([]byte, len(action.actionName))
-			copy(actionNameCopy, action.actionName)
-			actions[0] = string(actionNameCopy)
-			actions[1] = &action.crudTags
-			actions[2] = &action.version
-			entry[j+1] = &actions
+			actions := make([]interface{}, 3, 3)
+			actions[0] = action.actionName
+			actions[1] = action.crudTags
+			actions[2] = action.version
+			entry = append(entry, &actions)
 		}
 
-		classSpecs[i] = entry
+		if len(entry) > 1 {
+			classSpecs = append(classSpecs, entry)
+		}
 	}
 	arr[7] = &classSpecs
 	arr[8] = &sp.timestamp
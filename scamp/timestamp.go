@@ -3,6 +3,7 @@ package scamp
 import "fmt"
 import "strconv"
 import "syscall"
+import "time"
 
 type highResTimestamp float64
 
@@ -23,3 +24,13 @@ func getTimeOfDay() (ts highResTimestamp, err error) {
 	ts = highResTimestamp(f)
 	return
 }
+
+// Time converts the timestamp to a time.Time. Some implementations announce
+// milliseconds rather than seconds; those are recognised by their size.
+func (ts highResTimestamp) Time() time.Time {
+	seconds := float64(ts)
+	if seconds > 1e11 {
+		seconds /= 1000
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package scamp
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// cacheWatchMask covers writes in place as well as a new file being renamed over the
+// cache, which is how discovery agents replace it.
+const cacheWatchMask = unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_MOVED_TO |
+	unix.IN_CREATE | unix.IN_DELETE
+
+// cacheWatchPoll bounds how long the watcher blocks before checking ctx
+const cacheWatchPoll = 250 * time.Millisecond
+
+// watchCacheFile calls changed once events on path have settled for debounce. The
+// directory is watched rather than the file so a rename keeps being noticed after the
+// original inode is gone. It returns when ctx is done, or with an error if inotify is
+// not available.
+func watchCacheFile(ctx context.Context, path string, debounce time.Duration, changed func()) (err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return
+	}
+	defer unix.Close(fd)
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	_, err = unix.InotifyAddWatch(fd, dir, cacheWatchMask)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	var pending time.Time
+
+	for ctx.Err() == nil {
+		timeout := cacheWatchPoll
+		if !pending.IsZero() {
+			timeout = time.Until(pending)
+			if timeout <= 0 {
+				pending = time.Time{}
+				changed()
+				continue
+			}
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		_, err = unix.Poll(fds, int(timeout/time.Millisecond)+1)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return
+		}
+		if fds[0].Revents&unix.POLLIN == 0 {
+			continue
+		}
+
+		var n int
+		n, err = unix.Read(fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		if inotifyNamesFile(buf[:n], name) {
+			pending = time.Now().Add(debounce)
+		}
+	}
+
+	return nil
+}
+
+// inotifyNamesFile reports whether any event in buf is about name, or is an overflow
+// which may have hidden one.
+func inotifyNamesFile(buf []byte, name string) bool {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + unix.SizeofInotifyEvent
+		end := start + int(event.Len)
+		offset = end
+
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			return true
+		}
+		if end > len(buf) {
+			break
+		}
+
+		eventName := bytes.TrimRight(buf[start:end], "\x00")
+		if string(eventName) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package scamp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// watchCacheFile is only implemented with inotify; elsewhere the refresher keeps
+// polling, which is cheap because Refresh skips unchanged files.
+func watchCacheFile(ctx context.Context, path string, debounce time.Duration, changed func()) error {
+	return errors.New("watching the discovery cache is not supported on this platform")
+}